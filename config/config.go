@@ -1,27 +1,391 @@
 package config
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Database string `yaml:"database"`
+	// Language of texts shown in Discord and sent to Telegram: "en" (default) or "ru"
+	Language string `yaml:"language"`
+	// Rules applied to links of posts, by default links to Telegram are hidden in posts without signature and forward
+	Links []*LinkRule `yaml:"links"`
 
 	*Telegram `yaml:"telegram"`
 	*Discord  `yaml:"discord"`
 
+	Routes []*Route `yaml:"routes"`
+	// Discord channels to post from into Telegram channels, disabled if empty
+	Reverse []*ReverseRoute `yaml:"reverse"`
+
+	*Outbox `yaml:"outbox"`
+
 	*Proxy `yaml:"proxy"`
+
+	// Address to serve metrics on at /debug/vars, e.g. "localhost:9100", disabled if empty
+	Metrics string `yaml:"metrics"`
 }
 
 type Telegram struct {
 	Token string `yaml:"token"`
 	Debug string `yaml:"debug"`
+
+	// Chat IDs or @usernames posts are accepted from. If empty, chats from routes are used.
+	AllowedChats []string `yaml:"allowed_chats"`
+	// Leave chats that are not allowed
+	LeaveUnknownChats bool `yaml:"leave_unknown_chats"`
+
+	// Receive updates with webhook instead of long polling
+	Webhook *TelegramWebhook `yaml:"webhook"`
+
+	// Bot API server URL, https://api.telegram.org by default
+	APIEndpoint string `yaml:"api_endpoint"`
+	// Self-hosted Bot API server runs with --local and shares file system with the bot,
+	// so files of any size are read from disk
+	Local bool `yaml:"local"`
 }
 
+// Telegram limits of file size the bot can download
+const (
+	MaxDownloadSize      = 20 << 20
+	MaxLocalDownloadSize = 2000 << 20
+)
+
+func (t *Telegram) apiEndpoint() string {
+	if t.APIEndpoint == "" {
+		return "https://api.telegram.org"
+	}
+
+	return strings.TrimRight(t.APIEndpoint, "/")
+}
+
+// GetAPIEndpoint returns format of Bot API method URL with token and method name
+func (t *Telegram) GetAPIEndpoint() string {
+	return t.apiEndpoint() + "/bot%s/%s"
+}
+
+// GetFileEndpoint returns format of file download URL with token and file path
+func (t *Telegram) GetFileEndpoint() string {
+	return t.apiEndpoint() + "/file/bot%s/%s"
+}
+
+// GetMaxDownloadSize returns size of the largest file the bot can download
+func (t *Telegram) GetMaxDownloadSize() int {
+	if t.Local {
+		return MaxLocalDownloadSize
+	}
+
+	return MaxDownloadSize
+}
+
+type TelegramWebhook struct {
+	// Public URL Telegram sends updates to
+	URL string `yaml:"url"`
+	// Address of embedded HTTP server, e.g. ":8443"
+	Listen string `yaml:"listen"`
+	// Path to handle updates on, path of url by default
+	Path string `yaml:"path"`
+	// TLS certificate and key files. Plain HTTP is served without them (e.g. behind reverse proxy).
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Upload cert to Telegram, required for self-signed certificates
+	SelfSigned bool `yaml:"self_signed"`
+	// Checked against X-Telegram-Bot-Api-Secret-Token header of every request, random one if empty
+	SecretToken string `yaml:"secret_token"`
+}
+
+const (
+	DeliveryBot     = "bot"
+	DeliveryWebhook = "webhook"
+)
+
+const (
+	PollsEmbed  = "embed"
+	PollsNative = "native"
+)
+
+const (
+	PreviewsOff       = "off"
+	PreviewsTelegram  = "telegram"
+	PreviewsOpenGraph = "opengraph"
+)
+
 type Discord struct {
 	Token     string `yaml:"token"`
 	ChannelID string `yaml:"channel_id"`
+	// How reposts are sent: "bot" (default) or "webhook" with Telegram chat title and photo as author
+	Delivery string `yaml:"delivery"`
+	// How polls are reposted: "embed" (default) with results, or "native" Discord polls members can vote in.
+	// Quizzes are always reposted as embeds.
+	Polls string `yaml:"polls"`
+	// Duration of native polls without time limit in Telegram, 24 hours by default
+	PollDuration string `yaml:"poll_duration"`
+	// Telegram custom emoji IDs to Discord emoji (<:name:id>) shown instead of them
+	Emoji map[string]string `yaml:"emoji"`
+	// Guild ID custom emoji missing in emoji map are uploaded to. If empty, their Unicode alternative is shown.
+	ImportEmoji string `yaml:"import_emoji"`
+	// Embed previewing the link Telegram shows preview of: "off" (default), "telegram" with just the link,
+	// or "opengraph" with title, description and image of the page fetched through the proxy
+	LinkPreviews string `yaml:"link_previews"`
+}
+
+func (d *Discord) UseWebhooks() bool {
+	return d.Delivery == DeliveryWebhook
+}
+
+func (d *Discord) UseNativePolls() bool {
+	return d.Polls == PollsNative
+}
+
+func (d *Discord) UseLinkPreviews() bool {
+	return d.LinkPreviews == PreviewsTelegram || d.LinkPreviews == PreviewsOpenGraph
+}
+
+func (d *Discord) GetPollDuration() time.Duration {
+	return parseDuration(d.PollDuration, 24*time.Hour)
+}
+
+// Route maps a Telegram chat to one or more Discord channels.
+// Telegram is either a chat ID (-1001234567890) or a public @username.
+type Route struct {
+	Telegram string         `yaml:"telegram"`
+	Discord  []*Destination `yaml:"discord"`
+	// Publish reposts in announcement channels of the route, true by default
+	Crosspost *bool `yaml:"crosspost"`
+	// Turn @mentions into links to Telegram profiles, true by default
+	Mentions *bool `yaml:"mentions"`
+	// Turn hashtags and cashtags into links to search in the public channel
+	Hashtags bool `yaml:"hashtags"`
+	// Layout of reposts, the default one is used where template is empty
+	Template *Template `yaml:"template"`
+	// Language of the route, overrides the global one
+	Language string `yaml:"language"`
+	// Link rules of the route, override the global ones
+	Links []*LinkRule `yaml:"links"`
+}
+
+const (
+	LinkHide    = "hide"
+	LinkKeep    = "keep"
+	LinkStrip   = "strip"
+	LinkRewrite = "rewrite"
+)
+
+// LinkRule tells what to do with links to the domain. Rules are applied in order until link is hidden or kept,
+// so tracking parameters may be stripped and domain rewritten for the same link.
+type LinkRule struct {
+	// Domain of links, its subdomains included. Empty domain matches any link.
+	Domain string `yaml:"domain"`
+	// "hide", "keep", "strip" tracking parameters or "rewrite" domain
+	Action string `yaml:"action"`
+	// Domain links are rewritten to
+	To string `yaml:"to"`
+	// Query parameters stripped, names ending with * are prefixes. Default are utm_*, si, fbclid and gclid.
+	Params []string `yaml:"params"`
+	// Apply the rule only to posts without author signature and forward
+	Anonymous bool `yaml:"anonymous"`
+}
+
+var defaultLinkRules = []*LinkRule{
+	{Domain: "t.me", Action: LinkHide, Anonymous: true},
+}
+
+var defaultTrackingParams = []string{"utm_*", "si", "fbclid", "gclid"}
+
+// GetParams returns query parameters stripped by the rule
+func (l *LinkRule) GetParams() []string {
+	if len(l.Params) == 0 {
+		return defaultTrackingParams
+	}
+
+	return l.Params
+}
+
+// checkLinkRules reports link rules with unknown action or without domain to rewrite to
+func (c *Config) checkLinkRules() error {
+	rules := append([]*LinkRule{}, c.Links...)
+	for _, r := range c.Routes {
+		rules = append(rules, r.Links...)
+	}
+
+	for _, l := range rules {
+		switch l.Action {
+		case LinkHide, LinkKeep, LinkStrip:
+		case LinkRewrite:
+			if l.To == "" {
+				return fmt.Errorf("link rule for %q rewrites to empty domain", l.Domain)
+			}
+		default:
+			return fmt.Errorf("unknown action %q of link rule for %q", l.Action, l.Domain)
+		}
+	}
+
+	return nil
+}
+
+// LinkRules returns link rules of the route of the Telegram chat, the global ones if the route has none
+func (c *Config) LinkRules(chatID int64, userName string) []*LinkRule {
+	if r := c.FindRoute(chatID, userName); r != nil && r.Links != nil {
+		return r.Links
+	}
+	if c.Links != nil {
+		return c.Links
+	}
+
+	return defaultLinkRules
+}
+
+// Template defines layout of reposts with Go text/template templates.
+// https://pkg.go.dev/text/template
+type Template struct {
+	// Text of reposts without embed
+	Content string `yaml:"content"`
+	// Texts of the embed
+	Title       string `yaml:"title"`
+	Description string `yaml:"description"`
+	Footer      string `yaml:"footer"`
+	Author      string `yaml:"author"`
+	// Color of the embed, e.g. "#30a3e6"
+	Color  string           `yaml:"color"`
+	Fields []*TemplateField `yaml:"fields"`
+}
+
+// TemplateField is a field of the embed, it is skipped if its name or value is empty
+type TemplateField struct {
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value"`
+	Inline bool   `yaml:"inline"`
+}
+
+// All returns all templates, empty ones included
+func (t *Template) All() []string {
+	result := []string{t.Content, t.Title, t.Description, t.Footer, t.Author, t.Color}
+	for _, f := range t.Fields {
+		result = append(result, f.Name, f.Value)
+	}
+
+	return result
+}
+
+// ShouldLinkMentions reports whether mentions in posts of the route are turned into links
+func (r *Route) ShouldLinkMentions() bool {
+	return r.Mentions == nil || *r.Mentions
+}
+
+const (
+	DestinationText  = "text"
+	DestinationForum = "forum"
+)
+
+// Destination is a Discord channel posts are reposted to.
+// In config it is either just a channel ID or a map with options.
+type Destination struct {
+	ChannelID string `yaml:"channel_id"`
+	// "text" (default) or "forum" to start new forum post (thread) for every Telegram post
+	Type string `yaml:"type"`
+	// Telegram hashtags (without #) to names or IDs of forum tags.
+	// If empty, hashtags are applied as tags with the same names.
+	Tags map[string]string `yaml:"tags"`
+	// Publish reposts in announcement channel to following servers, true by default.
+	// Overrides the option of the route.
+	Crosspost *bool `yaml:"crosspost"`
+}
+
+func (d *Destination) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var channelID string
+	if err := unmarshal(&channelID); err == nil {
+		d.ChannelID = channelID
+		return nil
+	}
+
+	type plain Destination
+	return unmarshal((*plain)(d))
+}
+
+func (d *Destination) IsForum() bool {
+	return d.Type == DestinationForum
+}
+
+func (d *Destination) ShouldCrosspost() bool {
+	return d.Crosspost == nil || *d.Crosspost
+}
+
+// withRoute returns copy of the destination with options of the route it is in
+func (d *Destination) withRoute(r *Route) *Destination {
+	result := *d
+	if result.Crosspost == nil {
+		result.Crosspost = r.Crosspost
+	}
+
+	return &result
+}
+
+// ReverseRoute maps a Discord channel to a Telegram chat (ID or @username) its messages are posted to
+type ReverseRoute struct {
+	Discord  string `yaml:"discord"`
+	Telegram string `yaml:"telegram"`
+}
+
+// ReverseChats returns Telegram chats messages of the Discord channel should be posted to
+func (c *Config) ReverseChats(channelID string) []string {
+	var result []string
+	for _, r := range c.Reverse {
+		if r.Discord == channelID {
+			result = append(result, r.Telegram)
+		}
+	}
+
+	return result
+}
+
+// Outbox configures retries of failed reposts
+type Outbox struct {
+	// Attempts before repost becomes dead letter
+	MaxAttempts int `yaml:"max_attempts"`
+	// Delay before the first retry, doubled after each attempt, e.g. "30s"
+	Backoff string `yaml:"backoff"`
+	// Max delay between retries, e.g. "1h"
+	MaxBackoff string `yaml:"max_backoff"`
+}
+
+const (
+	defaultMaxAttempts = 10
+	defaultBackoff     = 30 * time.Second
+	defaultMaxBackoff  = time.Hour
+)
+
+func (o *Outbox) GetMaxAttempts() int {
+	if o == nil || o.MaxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+func (o *Outbox) GetBackoff() time.Duration {
+	if o == nil {
+		return defaultBackoff
+	}
+	return parseDuration(o.Backoff, defaultBackoff)
+}
+
+func (o *Outbox) GetMaxBackoff() time.Duration {
+	if o == nil {
+		return defaultMaxBackoff
+	}
+	return parseDuration(o.MaxBackoff, defaultMaxBackoff)
+}
+
+func parseDuration(s string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
 }
 
 type Proxy struct {
@@ -31,6 +395,170 @@ type Proxy struct {
 	Password string `yaml:"password"`
 }
 
+// MatchChat reports whether ref (chat ID or @username) points to the given chat.
+func MatchChat(ref string, chatID int64, userName string) bool {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "@") {
+		return userName != "" && strings.EqualFold(ref[1:], userName)
+	}
+
+	return ref == strconv.FormatInt(chatID, 10)
+}
+
+// ParseChat returns chat ID or username (without @) of the chat reference
+func ParseChat(ref string) (chatID int64, userName string, err error) {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "@") {
+		return 0, ref[1:], nil
+	}
+	chatID, err = strconv.ParseInt(ref, 10, 64)
+
+	return chatID, "", err
+}
+
+// Destinations returns all Discord channels the posts of the Telegram chat should be reposted to.
+// If no routes configured, discord.channel_id is used for every chat.
+func (c *Config) Destinations(chatID int64, userName string) []*Destination {
+	if len(c.Routes) == 0 {
+		if c.Discord == nil || c.Discord.ChannelID == "" {
+			return nil
+		}
+		return []*Destination{{ChannelID: c.Discord.ChannelID}}
+	}
+
+	var result []*Destination
+	seen := make(map[string]struct{})
+	for _, r := range c.Routes {
+		if !MatchChat(r.Telegram, chatID, userName) {
+			continue
+		}
+		for _, d := range r.Discord {
+			if _, ok := seen[d.ChannelID]; ok {
+				continue
+			}
+			seen[d.ChannelID] = struct{}{}
+			result = append(result, d.withRoute(r))
+		}
+	}
+
+	return result
+}
+
+// FindRoute returns the first route of the Telegram chat, nil if there is none
+func (c *Config) FindRoute(chatID int64, userName string) *Route {
+	for _, r := range c.Routes {
+		if MatchChat(r.Telegram, chatID, userName) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// DefaultLanguage is used when language is not set in config
+const DefaultLanguage = "en"
+
+func (c *Config) routeLanguage(r *Route) string {
+	if r != nil && r.Language != "" {
+		return r.Language
+	}
+	if c.Language != "" {
+		return c.Language
+	}
+
+	return DefaultLanguage
+}
+
+// ChatLanguage returns language of the route of the Telegram chat, the global one if the chat has no route
+func (c *Config) ChatLanguage(chatID int64, userName string) string {
+	return c.routeLanguage(c.FindRoute(chatID, userName))
+}
+
+// ChannelLanguage returns language of the first route reposting to the Discord channel,
+// the global one if there is no such route
+func (c *Config) ChannelLanguage(channelID string) string {
+	for _, r := range c.Routes {
+		for _, d := range r.Discord {
+			if d.ChannelID == channelID {
+				return c.routeLanguage(r)
+			}
+		}
+	}
+
+	return c.routeLanguage(nil)
+}
+
+// Languages returns all languages set in config
+func (c *Config) Languages() []string {
+	result := []string{c.routeLanguage(nil)}
+	for _, r := range c.Routes {
+		result = append(result, c.routeLanguage(r))
+	}
+
+	return result
+}
+
+// FindDestination returns options of the Discord channel from routes.
+// Plain text channel is returned if the channel is not found.
+func (c *Config) FindDestination(channelID string) *Destination {
+	for _, r := range c.Routes {
+		for _, d := range r.Discord {
+			if d.ChannelID == channelID {
+				return d.withRoute(r)
+			}
+		}
+	}
+
+	return &Destination{ChannelID: channelID}
+}
+
+// AllDestinations returns all Discord channels posts are reposted to
+func (c *Config) AllDestinations() []*Destination {
+	if len(c.Routes) == 0 {
+		if c.Discord == nil || c.Discord.ChannelID == "" {
+			return nil
+		}
+		return []*Destination{{ChannelID: c.Discord.ChannelID}}
+	}
+
+	var result []*Destination
+	seen := make(map[string]struct{})
+	for _, r := range c.Routes {
+		for _, d := range r.Discord {
+			if _, ok := seen[d.ChannelID]; !ok {
+				seen[d.ChannelID] = struct{}{}
+				result = append(result, d.withRoute(r))
+			}
+		}
+	}
+
+	return result
+}
+
+// IsChatAllowed reports whether updates from the chat should be processed.
+// If neither telegram.allowed_chats nor routes configured, every chat is allowed.
+func (c *Config) IsChatAllowed(chatID int64, userName string) bool {
+	var refs []string
+	if c.Telegram != nil && len(c.Telegram.AllowedChats) > 0 {
+		refs = c.Telegram.AllowedChats
+	} else {
+		for _, r := range c.Routes {
+			refs = append(refs, r.Telegram)
+		}
+	}
+	if len(refs) == 0 {
+		return true
+	}
+
+	for _, ref := range refs {
+		if MatchChat(ref, chatID, userName) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func NewConfig(p string) (*Config, error) {
 	b, err := ioutil.ReadFile(p)
 	if err != nil {
@@ -41,6 +569,9 @@ func NewConfig(p string) (*Config, error) {
 	if err := yaml.Unmarshal(b, &c); err != nil {
 		return nil, err
 	}
+	if err := c.checkLinkRules(); err != nil {
+		return nil, err
+	}
 
 	return &c, nil
 }
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestMatchChat(t *testing.T) {
+	cases := map[string]struct {
+		Ref      string
+		ChatID   int64
+		UserName string
+		Expected bool
+	}{
+		"id":               {Ref: "-1001", ChatID: -1001, Expected: true},
+		"other id":         {Ref: "-1001", ChatID: -1002, UserName: "lorem", Expected: false},
+		"username":         {Ref: "@lorem", ChatID: -1001, UserName: "lorem", Expected: true},
+		"username case":    {Ref: " @Lorem ", ChatID: -1001, UserName: "lorem", Expected: true},
+		"private chat":     {Ref: "@lorem", ChatID: -1001, Expected: false},
+		"username as id":   {Ref: "lorem", ChatID: -1001, UserName: "lorem", Expected: false},
+		"id with username": {Ref: "-1001", ChatID: -1001, UserName: "lorem", Expected: true},
+	}
+
+	for name, c := range cases {
+		if got := MatchChat(c.Ref, c.ChatID, c.UserName); got != c.Expected {
+			t.Errorf("%s: got %v, expected %v", name, got, c.Expected)
+		}
+	}
+}
+
+func TestDestinations(t *testing.T) {
+	var conf Config
+	err := yaml.Unmarshal([]byte(`
+discord:
+  channel_id: "100"
+routes:
+  - telegram: "-1001"
+    discord: ["200", "300"]
+  - telegram: "@lorem"
+    crosspost: false
+    discord:
+      - "300"
+      - channel_id: "400"
+        type: "forum"
+        tags:
+          news: "Новости"
+      - channel_id: "500"
+        crosspost: true
+`), &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	no, yes := false, true
+	cases := map[string]struct {
+		ChatID   int64
+		UserName string
+		Expected []*Destination
+	}{
+		"strings": {
+			ChatID: -1001,
+			Expected: []*Destination{
+				{ChannelID: "200"},
+				{ChannelID: "300"},
+			},
+		},
+		"maps": {
+			ChatID:   -1002,
+			UserName: "lorem",
+			Expected: []*Destination{
+				{ChannelID: "300", Crosspost: &no},
+				{ChannelID: "400", Type: DestinationForum, Tags: map[string]string{"news": "Новости"}, Crosspost: &no},
+				{ChannelID: "500", Crosspost: &yes},
+			},
+		},
+		"both routes": {
+			ChatID:   -1001,
+			UserName: "lorem",
+			Expected: []*Destination{
+				{ChannelID: "200"},
+				{ChannelID: "300"},
+				{ChannelID: "400", Type: DestinationForum, Tags: map[string]string{"news": "Новости"}, Crosspost: &no},
+				{ChannelID: "500", Crosspost: &yes},
+			},
+		},
+		"no route": {
+			ChatID:   -1003,
+			UserName: "ipsum",
+			Expected: nil,
+		},
+	}
+
+	for name, c := range cases {
+		if got := conf.Destinations(c.ChatID, c.UserName); !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("%s: got %+v, expected %+v", name, got, c.Expected)
+		}
+	}
+
+	conf.Routes = nil
+	if got := conf.Destinations(-1003, ""); len(got) != 1 || got[0].ChannelID != "100" {
+		t.Errorf("without routes: got %+v, expected default channel", got)
+	}
+}
+
+func TestIsChatAllowed(t *testing.T) {
+	routes := []*Route{{Telegram: "-1001"}, {Telegram: "@lorem"}}
+	cases := map[string]struct {
+		Config   Config
+		ChatID   int64
+		UserName string
+		Expected bool
+	}{
+		"empty allowlist": {
+			Config:   Config{Telegram: &Telegram{}},
+			ChatID:   -1003,
+			Expected: true,
+		},
+		"no telegram section": {
+			Config:   Config{},
+			ChatID:   -1003,
+			Expected: true,
+		},
+		"route by id": {
+			Config:   Config{Telegram: &Telegram{}, Routes: routes},
+			ChatID:   -1001,
+			Expected: true,
+		},
+		"route by username": {
+			Config:   Config{Telegram: &Telegram{}, Routes: routes},
+			ChatID:   -1002,
+			UserName: "lorem",
+			Expected: true,
+		},
+		"not in routes": {
+			Config:   Config{Telegram: &Telegram{}, Routes: routes},
+			ChatID:   -1003,
+			UserName: "ipsum",
+			Expected: false,
+		},
+		"allowlist overrides routes": {
+			Config:   Config{Telegram: &Telegram{AllowedChats: []string{"@ipsum"}}, Routes: routes},
+			ChatID:   -1001,
+			Expected: false,
+		},
+		"allowlist by username": {
+			Config:   Config{Telegram: &Telegram{AllowedChats: []string{"@ipsum"}}, Routes: routes},
+			ChatID:   -1003,
+			UserName: "Ipsum",
+			Expected: true,
+		},
+	}
+
+	for name, c := range cases {
+		if got := c.Config.IsChatAllowed(c.ChatID, c.UserName); got != c.Expected {
+			t.Errorf("%s: got %v, expected %v", name, got, c.Expected)
+		}
+	}
+}
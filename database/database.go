@@ -12,13 +12,62 @@ type Database struct {
 }
 
 func (db *Database) AutoMigrate() error {
-	if err := db.Conn.AutoMigrate(&Post{}).Error; err != nil {
+	if err := db.migratePostsChannel(); err != nil {
+		return err
+	}
+
+	if err := db.Conn.AutoMigrate(&Post{}, &Webhook{}, &Outbox{}).Error; err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// migratePostsChannel moves posts created before routes support into the new table layout.
+// Old table had unique telegram column, so one post could not be reposted to several channels.
+// All old reposts were made to discord.channel_id.
+func (db *Database) migratePostsChannel() error {
+	if !db.Conn.HasTable(&Post{}) || db.Conn.Dialect().HasColumn("posts", "channel") {
+		return nil
+	}
+
+	tx := db.Conn.Begin()
+	steps := []func() error{
+		func() error {
+			return tx.Exec("ALTER TABLE posts RENAME TO posts_legacy").Error
+		},
+		func() error {
+			// Index is renamed together with the table and conflicts with the new one
+			return tx.Exec("DROP INDEX IF EXISTS idx_posts_deleted_at").Error
+		},
+		func() error {
+			return tx.CreateTable(&Post{}).Error
+		},
+		func() error {
+			channelID := ""
+			if db.conf.Discord != nil {
+				channelID = db.conf.Discord.ChannelID
+			}
+			return tx.Exec(
+				"INSERT INTO posts (id, created_at, updated_at, deleted_at, telegram, channel, discord, is_embed) "+
+					"SELECT id, created_at, updated_at, deleted_at, telegram, ?, discord, is_embed FROM posts_legacy",
+				channelID,
+			).Error
+		},
+		func() error {
+			return tx.DropTable("posts_legacy").Error
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
 func NewDatabase(conf *config.Config) (*Database, error) {
 	conn, err := gorm.Open("sqlite3", conf.Database)
 	if err != nil {
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxDead    = "dead"
+)
+
+// Outbox is a repost to the Discord channel that failed and waits for retry.
+// Posts that failed too many times become dead letters and are not retried until requeued.
+type Outbox struct {
+	gorm.Model
+	Chat    int64
+	Channel string
+	// JSON of Telegram posts to repost, several for album
+	Payload string
+	// JSON of fields of the posts tgbotapi does not know about, in the same order
+	Info        string
+	Status      string `gorm:"index"`
+	Attempts    int
+	NextAttempt time.Time `gorm:"index"`
+	LastError   string
+}
+
+func (Outbox) TableName() string {
+	return "outbox"
+}
+
+type OutboxManager struct {
+	Data *Outbox
+	DB   *gorm.DB
+}
+
+func (om *OutboxManager) Create() error {
+	return om.DB.Create(&om.Data).Error
+}
+
+func (om *OutboxManager) Save() error {
+	return om.DB.Save(&om.Data).Error
+}
+
+func (om *OutboxManager) Delete() error {
+	return om.DB.Unscoped().Delete(&om.Data).Error
+}
+
+func (om *OutboxManager) FindByID() error {
+	return om.DB.Model(&Outbox{}).Where("id = ?", om.Data.ID).First(&om.Data).Error
+}
+
+// FindDue returns pending entries which time to retry has come.
+func (om *OutboxManager) FindDue(now time.Time) ([]Outbox, error) {
+	var entries []Outbox
+	err := om.DB.Model(&Outbox{}).
+		Where("status = ? AND next_attempt <= ?", OutboxPending, now).
+		Order("next_attempt").
+		Find(&entries).Error
+
+	return entries, err
+}
+
+// FindDead returns entries which exceeded max attempts.
+func (om *OutboxManager) FindDead() ([]Outbox, error) {
+	var entries []Outbox
+	err := om.DB.Model(&Outbox{}).Where("status = ?", OutboxDead).Order("id").Find(&entries).Error
+
+	return entries, err
+}
+
+// Requeue makes dead letter pending again with reset attempts counter.
+func (om *OutboxManager) Requeue() error {
+	om.Data.Status = OutboxPending
+	om.Data.Attempts = 0
+	om.Data.NextAttempt = time.Now()
+
+	return om.Save()
+}
@@ -4,17 +4,52 @@ import (
 	"github.com/jinzhu/gorm"
 )
 
+const (
+	// Telegram post reposted to Discord
+	DirectionToDiscord = "to_discord"
+	// Discord message posted to Telegram by reverse bridge
+	DirectionToTelegram = "to_telegram"
+)
+
+// Post links Telegram post ("chat_id,message_id") with its repost in the Discord channel.
+// One Telegram post may have reposts in several channels.
 type Post struct {
 	gorm.Model
-	Telegram string `gorm:"unique"`
-	Discord  string `gorm:"unique"`
+	Telegram string `gorm:"index"`
+	Channel  string
+	Discord  string `gorm:"index"`
 	IsEmbed  bool
+	// Number of Discord message when post was split into several ones, the first one (0) holds the text
+	Part int
+	// Number of the text part the message holds when long text was split into several messages,
+	// 0 for the first part and for messages without text
+	Chunk int
+	// Unique ID of the Telegram file and ID of its Discord attachment, if the message holds file of the post
+	Media      string
+	Attachment string
+	// ID of the webhook the repost was sent with, empty if sent by the bot itself
+	Webhook string
+	// ID of the forum thread holding the repost, empty if reposted to text channel
+	Thread string
+	// ID of the Telegram poll, if the post is a poll
+	Poll string `gorm:"index"`
+	// Which of the messages is the original one
+	Direction string `gorm:"index;default:'to_discord'"`
 }
 
 func (Post) TableName() string {
 	return "posts"
 }
 
+// MessageChannel returns ID of the channel or thread the repost message is in
+func (p *Post) MessageChannel() string {
+	if p.Thread != "" {
+		return p.Thread
+	}
+
+	return p.Channel
+}
+
 type PostManager struct {
 	Data *Post
 	DB   *gorm.DB
@@ -24,6 +59,53 @@ func (pm *PostManager) Create() error {
 	return pm.DB.Create(&pm.Data).Error
 }
 
+func (pm *PostManager) Save() error {
+	return pm.DB.Save(&pm.Data).Error
+}
+
+func (pm *PostManager) Delete() error {
+	return pm.DB.Unscoped().Delete(&pm.Data).Error
+}
+
 func (pm *PostManager) FindByTelegramPost() error {
 	return pm.DB.Model(&Post{}).Where("telegram = ?", pm.Data.Telegram).First(&pm.Data).Error
 }
+
+// FindAllByTelegramPost returns reposts of the Telegram post in all Discord channels.
+func (pm *PostManager) FindAllByTelegramPost() ([]Post, error) {
+	var posts []Post
+	err := pm.DB.Model(&Post{}).Where("telegram = ? AND direction = ?", pm.Data.Telegram, DirectionToDiscord).Find(&posts).Error
+
+	return posts, err
+}
+
+// FindAllByPoll returns reposts of the Telegram poll in all Discord channels.
+func (pm *PostManager) FindAllByPoll() ([]Post, error) {
+	var posts []Post
+	err := pm.DB.Model(&Post{}).Where("poll = ?", pm.Data.Poll).Find(&posts).Error
+
+	return posts, err
+}
+
+// FindAllByDiscordMessage returns posts the Discord message was posted as to Telegram.
+func (pm *PostManager) FindAllByDiscordMessage() ([]Post, error) {
+	var posts []Post
+	err := pm.DB.Model(&Post{}).Where("discord = ? AND direction = ?", pm.Data.Discord, DirectionToTelegram).Order("part").Find(&posts).Error
+
+	return posts, err
+}
+
+// IsMirror reports that the Telegram post (or Discord message if Telegram is empty) was posted by the bot itself
+// in the opposite direction, so it must not be sent back.
+func (pm *PostManager) IsMirror() (bool, error) {
+	var count int
+	query := pm.DB.Model(&Post{})
+	if pm.Data.Telegram != "" {
+		query = query.Where("telegram = ? AND direction = ?", pm.Data.Telegram, DirectionToTelegram)
+	} else {
+		query = query.Where("discord = ? AND direction = ?", pm.Data.Discord, DirectionToDiscord)
+	}
+	err := query.Count(&count).Error
+
+	return count > 0, err
+}
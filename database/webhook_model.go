@@ -0,0 +1,45 @@
+package database
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// Webhook is a Discord webhook created by the bot to repost posts of a Telegram chat into a channel.
+type Webhook struct {
+	gorm.Model
+	Channel   string `gorm:"unique_index:idx_webhooks_channel_chat"`
+	Chat      int64  `gorm:"unique_index:idx_webhooks_channel_chat"`
+	WebhookID string `gorm:"unique"`
+	Token     string
+	// Unique file ID of the Telegram chat photo used as webhook avatar
+	Photo string
+}
+
+func (Webhook) TableName() string {
+	return "webhooks"
+}
+
+type WebhookManager struct {
+	Data *Webhook
+	DB   *gorm.DB
+}
+
+func (wm *WebhookManager) Create() error {
+	return wm.DB.Create(&wm.Data).Error
+}
+
+func (wm *WebhookManager) Save() error {
+	return wm.DB.Save(&wm.Data).Error
+}
+
+func (wm *WebhookManager) Delete() error {
+	return wm.DB.Unscoped().Delete(&wm.Data).Error
+}
+
+func (wm *WebhookManager) FindByChannelChat() error {
+	return wm.DB.Model(&Webhook{}).Where("channel = ? AND chat = ?", wm.Data.Channel, wm.Data.Chat).First(&wm.Data).Error
+}
+
+func (wm *WebhookManager) FindByWebhookID() error {
+	return wm.DB.Model(&Webhook{}).Where("webhook_id = ?", wm.Data.WebhookID).First(&wm.Data).Error
+}
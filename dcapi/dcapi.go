@@ -12,6 +12,11 @@ func NewSession(conf *config.Config) (*discordgo.Session, error) {
 		return nil, err
 	}
 
+	// Reverse bridge reads content of messages
+	if len(conf.Reverse) > 0 {
+		s.Identify.Intents |= discordgo.IntentMessageContent
+	}
+
 	// Open websocket connetction
 	err = s.Open()
 	if err != nil {
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"reposter/config"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Telegram sends every post of album as separate update, wait for the rest after the last one received
+	albumWait = 2 * time.Second
+	// Discord limit of attachments per message
+	maxAttachments = 10
+)
+
+type album struct {
+	Messages []*tgbotapi.Message
+	send     func([]*tgbotapi.Message)
+	timer    *time.Timer
+}
+
+var (
+	albums   = make(map[string]*album)
+	albumsMu sync.Mutex
+	// Held while update is handled or buffered album is sent, so reposts keep order of posts
+	deliveryMu sync.Mutex
+)
+
+func albumKey(msg *tgbotapi.Message) string {
+	return fmt.Sprintf("%d,%s", msg.Chat.ID, msg.MediaGroupID)
+}
+
+// sendAlbum sends posts of the album in order of their IDs
+func (a *album) sendAlbum() {
+	sort.Slice(a.Messages, func(i, j int) bool {
+		return a.Messages[i].MessageID < a.Messages[j].MessageID
+	})
+	a.send(a.Messages)
+}
+
+// takeAlbum removes the album from buffer. Returns false if it was already taken.
+func takeAlbum(key string, a *album) bool {
+	albumsMu.Lock()
+	defer albumsMu.Unlock()
+
+	if albums[key] != a {
+		return false
+	}
+	delete(albums, key)
+
+	return true
+}
+
+// bufferAlbum collects posts of the media group and calls send with all of them
+// when no more posts of the group received during albumWait.
+func bufferAlbum(msg *tgbotapi.Message, send func([]*tgbotapi.Message)) {
+	key := albumKey(msg)
+
+	albumsMu.Lock()
+	defer albumsMu.Unlock()
+
+	a, ok := albums[key]
+	if ok {
+		a.Messages = append(a.Messages, msg)
+		a.timer.Reset(albumWait)
+		return
+	}
+
+	a = &album{
+		Messages: []*tgbotapi.Message{msg},
+		send:     send,
+	}
+	a.timer = time.AfterFunc(albumWait, func() {
+		deliveryMu.Lock()
+		defer deliveryMu.Unlock()
+
+		if takeAlbum(key, a) {
+			a.sendAlbum()
+		}
+	})
+	albums[key] = a
+}
+
+// flushAlbums sends buffered albums right away except the one with the key, so later posts and edits
+// are not handled before them. Must be called with deliveryMu held.
+func flushAlbums(except string) {
+	albumsMu.Lock()
+	var pending []*album
+	for key, a := range albums {
+		if key == except {
+			continue
+		}
+		a.timer.Stop()
+		delete(albums, key)
+		pending = append(pending, a)
+	}
+	albumsMu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Messages[0].Date < pending[j].Messages[0].Date
+	})
+	for _, a := range pending {
+		a.sendAlbum()
+	}
+}
+
+// uniqueFileName adds number to the file name if such name already taken
+func uniqueFileName(name string, taken map[string]struct{}) string {
+	result := name
+	ext := path.Ext(name)
+	for i := 2; ; i++ {
+		if _, ok := taken[result]; !ok {
+			break
+		}
+		result = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	taken[result] = struct{}{}
+
+	return result
+}
+
+// renderAlbumText builds the first Discord message of album holding its text
+func renderAlbumText(conf *config.Config, captioned *tgbotapi.Message) *repost {
+	r := &repost{
+		Embed: formatEmbed(conf, captioned),
+	}
+	// If description is empty then no need embed
+	if r.Embed.MessageEmbed.Description == "" {
+		r.Embed = nil
+		r.Content = formatMessage(conf, captioned)
+	}
+
+	return r
+}
+
+// newAlbumReposts builds Discord messages from posts of the album.
+// Text of the album goes to the first message, files are split by maxAttachments per message.
+// Returns placement of every post file.
+func newAlbumReposts(conf *config.Config, client *http.Client, tgbot *tgbotapi.BotAPI, msgs []*tgbotapi.Message) ([]*repost, []placement, error) {
+	// Album caption is the caption of its first post, but any post can have own one
+	captioned := msgs[0]
+	for _, msg := range msgs {
+		if msg.Caption != "" {
+			captioned = msg
+			break
+		}
+	}
+
+	reposts := []*repost{renderAlbumText(conf, captioned)}
+	places := make([]placement, len(msgs))
+	taken := make(map[string]struct{})
+	for i, msg := range msgs {
+		places[i] = placement{0, -1}
+		file := getMedia(msg)
+		if file == nil {
+			continue
+		}
+
+		a, err := downloadMedia(conf, client, tgbot, msg, file)
+		if err != nil {
+			return nil, nil, err
+		}
+		a.Name = uniqueFileName(file.Name, taken)
+
+		last := reposts[len(reposts)-1]
+		if len(last.Files) == maxAttachments {
+			last = &repost{}
+			reposts = append(reposts, last)
+		}
+		last.Files = append(last.Files, a)
+		places[i] = placement{len(reposts) - 1, len(last.Files) - 1}
+	}
+
+	return reposts, places, nil
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"reposter/config"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// albumPost returns post of the album with photo too large to download, so media is linked without Bot API
+func albumPost(id int, group, caption string) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID:    id,
+		Chat:         &tgbotapi.Chat{ID: -1001, Type: "channel", Title: "Lorem"},
+		Date:         1700000000,
+		MediaGroupID: group,
+		Caption:      caption,
+		Photo: []tgbotapi.PhotoSize{
+			{FileID: "file", FileUniqueID: "unique", FileSize: uploadLimitTier3 + 1},
+		},
+	}
+}
+
+func messageIDs(msgs []*tgbotapi.Message) []int {
+	var ids []int
+	for _, msg := range msgs {
+		ids = append(ids, msg.MessageID)
+	}
+
+	return ids
+}
+
+func TestBufferAlbum(t *testing.T) {
+	var sent [][]int
+	send := func(msgs []*tgbotapi.Message) {
+		sent = append(sent, messageIDs(msgs))
+	}
+	for _, msg := range []*tgbotapi.Message{
+		albumPost(3, "first", ""),
+		albumPost(1, "first", "Lorem"),
+		albumPost(5, "second", ""),
+		albumPost(2, "first", ""),
+		albumPost(4, "second", ""),
+	} {
+		bufferAlbum(msg, send)
+	}
+
+	deliveryMu.Lock()
+	flushAlbums(albumKey(albumPost(4, "second", "")))
+	deliveryMu.Unlock()
+	if expected := [][]int{{1, 2, 3}}; !reflect.DeepEqual(sent, expected) {
+		t.Errorf("got %v, expected %v", sent, expected)
+	}
+
+	deliveryMu.Lock()
+	flushAlbums("")
+	deliveryMu.Unlock()
+	if expected := [][]int{{1, 2, 3}, {4, 5}}; !reflect.DeepEqual(sent, expected) {
+		t.Errorf("got %v, expected %v", sent, expected)
+	}
+}
+
+func TestNewAlbumReposts(t *testing.T) {
+	conf := &config.Config{Telegram: &config.Telegram{}, Discord: &config.Discord{}}
+	var msgs []*tgbotapi.Message
+	for id := 1; id <= 12; id++ {
+		caption := ""
+		if id == 3 {
+			caption = "Lorem markdownum"
+		}
+		msgs = append(msgs, albumPost(id, "album", caption))
+	}
+
+	reposts, places, err := newAlbumReposts(conf, nil, nil, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reposts) != 2 || len(reposts[0].Files) != maxAttachments || len(reposts[1].Files) != 2 {
+		t.Fatalf("got %d reposts, expected 10 files in the first and 2 in the second", len(reposts))
+	}
+	if reposts[0].Embed == nil || reposts[0].Embed.Description != "Lorem markdownum" {
+		t.Errorf("album text is not in the first repost")
+	}
+	if reposts[1].Embed != nil || reposts[1].Content != "" {
+		t.Errorf("album text is repeated in the second repost")
+	}
+	if name := reposts[1].Files[1].Name; name != "photo_12.jpg" {
+		t.Errorf("got file name %q, expected unique one", name)
+	}
+	expected := []placement{{0, 0}, {0, 1}, {0, 2}, {0, 3}, {0, 4}, {0, 5}, {0, 6}, {0, 7}, {0, 8}, {0, 9}, {1, 0}, {1, 1}}
+	if !reflect.DeepEqual(places, expected) {
+		t.Errorf("got placements %v, expected %v", places, expected)
+	}
+}
@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"reposter/config"
+	"reposter/database"
+	"reposter/tgapi"
+
+	embed "github.com/Clinet/discordgo-embed"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// How long linked channel of the discussion group is cached before asking getChat again
+const linkedChatTTL = 10 * time.Minute
+
+// How long failed getChat is cached. Chats which cannot be got are not discussion groups meanwhile,
+// so updates from not allowed chats do not ask Telegram every time.
+const linkedChatErrorTTL = time.Minute
+
+type linkedChat struct {
+	// Channel the group is linked to, nil if the group is not a discussion group
+	Channel *tgbotapi.Chat
+	Expires time.Time
+}
+
+var (
+	linkedChats   = make(map[int64]*linkedChat)
+	linkedChatsMu sync.Mutex
+)
+
+// linkedChannel returns Telegram channel the discussion group is linked to, nil if the chat is not a discussion group.
+func linkedChannel(tgbot *tgbotapi.BotAPI, chat *tgbotapi.Chat) *tgbotapi.Chat {
+	if !chat.IsSuperGroup() {
+		return nil
+	}
+
+	linkedChatsMu.Lock()
+	cached := linkedChats[chat.ID]
+	linkedChatsMu.Unlock()
+	if cached != nil && time.Now().Before(cached.Expires) {
+		return cached.Channel
+	}
+
+	linked := &linkedChat{Expires: time.Now().Add(linkedChatTTL)}
+	group, err := tgbot.GetChat(tgbotapi.ChatInfoConfig{ChatConfig: tgbotapi.ChatConfig{ChatID: chat.ID}})
+	if err != nil {
+		log.Printf("Cannot get chat info! See error: %s", err.Error())
+		linked.Expires = time.Now().Add(linkedChatErrorTTL)
+	} else if group.LinkedChatID != 0 {
+		channel, err := tgbot.GetChat(tgbotapi.ChatInfoConfig{ChatConfig: tgbotapi.ChatConfig{ChatID: group.LinkedChatID}})
+		if err != nil {
+			log.Printf("Cannot get chat info! See error: %s", err.Error())
+			linked.Expires = time.Now().Add(linkedChatErrorTTL)
+		} else if channel.IsChannel() {
+			linked.Channel = &channel
+		}
+	}
+
+	linkedChatsMu.Lock()
+	linkedChats[chat.ID] = linked
+	linkedChatsMu.Unlock()
+
+	return linked.Channel
+}
+
+// isDiscussionOf reports that the chat is discussion group of allowed channel
+func isDiscussionOf(conf *config.Config, tgbot *tgbotapi.BotAPI, chat *tgbotapi.Chat) bool {
+	channel := linkedChannel(tgbot, chat)
+	return channel != nil && conf.IsChatAllowed(channel.ID, channel.UserName)
+}
+
+// commentAuthor returns name of the user who left the comment, or title of the chat it was left on behalf of
+func commentAuthor(msg *tgbotapi.Message) string {
+	if msg.SenderChat != nil {
+		return msg.SenderChat.Title
+	}
+	if msg.From == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(msg.From.FirstName + " " + msg.From.LastName)
+}
+
+// withAuthor returns copy of the repost signed with name of the comment author.
+// Webhooks show the name as their username, messages of the bot are prefixed with it.
+func (r *repost) withAuthor(name string, webhook bool) *repost {
+	result := *r
+	if name == "" {
+		return &result
+	}
+
+	if webhook {
+		result.Username = name
+	} else if result.Embed != nil {
+		e := *result.Embed.MessageEmbed
+		e.Author = &discordgo.MessageEmbedAuthor{Name: name}
+		result.Embed = &embed.Embed{MessageEmbed: &e}
+	} else {
+		result.Content = "**" + tgapi.EntitiesToDiscordMarkdown(name, nil) + "**\n" + result.Content
+	}
+
+	return &result
+}
+
+// commentedReposts returns reposts the comment belongs to: reposts of the commented channel post,
+// or mirrored comments the comment replies to. Nil if the message is not a comment of reposted post.
+func commentedReposts(db *database.Database, msg *tgbotapi.Message) []database.Post {
+	replied := msg.ReplyToMessage
+	if replied == nil {
+		return nil
+	}
+
+	// Comment replies to the channel post automatically forwarded to discussion group
+	telegram := telegramPostID(replied)
+	if replied.IsAutomaticForward && replied.ForwardFromChat != nil {
+		telegram = telegramPostID(&tgbotapi.Message{
+			MessageID: replied.ForwardFromMessageID,
+			Chat:      replied.ForwardFromChat,
+		})
+	}
+
+	pm := database.PostManager{
+		DB: db.Conn,
+		Data: &database.Post{
+			Telegram: telegram,
+		},
+	}
+	posts, err := pm.FindAllByTelegramPost()
+	if err != nil {
+		log.Printf("Cannot read record in database! See error: %s", err.Error())
+		return nil
+	}
+
+	var result []database.Post
+	for _, p := range posts {
+		if p.Part == 0 {
+			result = append(result, p)
+		}
+	}
+
+	return result
+}
+
+// commentThread returns thread for comments of the repost, starting it on the repost message if there is none yet.
+func commentThread(dcbot *discordgo.Session, p *database.Post, replied *tgbotapi.Message) (string, error) {
+	// Forum posts and comments are already in thread
+	if p.Thread != "" {
+		return p.Thread, nil
+	}
+
+	th, err := dcbot.MessageThreadStartComplex(p.Channel, p.Discord, &discordgo.ThreadStart{
+		Name:                threadName([]*tgbotapi.Message{replied}),
+		AutoArchiveDuration: 1440,
+	})
+	if err == nil {
+		return th.ID, nil
+	}
+
+	// Thread started on the message has the same ID
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeThreadAlreadyCreatedForThisMessage {
+		return p.Discord, nil
+	}
+
+	return "", err
+}
+
+// mirrorComment sends comment from the discussion group to the thread of the commented repost in every channel.
+func mirrorComment(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, msg *tgbotapi.Message) {
+	reposts := commentedReposts(db, msg)
+	if len(reposts) == 0 {
+		return
+	}
+
+	r, err := newRepost(conf, client, tgbot, msg)
+	if err != nil {
+		log.Printf("Cannot mirror comment! See error: %s", err.Error())
+		return
+	}
+	if r == nil {
+		return
+	}
+	r = r.withAuthor(commentAuthor(msg), conf.Discord.UseWebhooks())
+	var file *attachment
+	if len(r.Files) > 0 {
+		file = r.Files[0]
+	}
+
+	for i := range reposts {
+		p := &reposts[i]
+		r, indexes := r.fitTo(channelUploadLimit(dcbot, p.Channel))
+		thread, err := commentThread(dcbot, p, msg.ReplyToMessage)
+		if err != nil {
+			log.Printf("Cannot start thread for comments in channel %s! See error: %s", p.Channel, err.Error())
+			continue
+		}
+
+		// Long comment is continued in the next messages
+		for k, part := range r.split() {
+			m, wh, err := sendRepost(conf, db, client, tgbot, dcbot, p.Channel, thread, msg.Chat, part)
+			if err != nil {
+				log.Printf("Cannot mirror comment to channel %s! See error: %s", p.Channel, err.Error())
+				break
+			}
+
+			comment := &database.Post{
+				Telegram: telegramPostID(msg),
+				Channel:  p.Channel,
+				Discord:  m.ID,
+				IsEmbed:  part.Embed != nil,
+				Thread:   thread,
+				Part:     k,
+				Chunk:    k,
+			}
+			if wh != nil {
+				comment.Webhook = wh.WebhookID
+			}
+			// Remember the file to replace it when media of the comment edited
+			if k == 0 && len(indexes) > 0 {
+				comment.Media = file.Media
+				if indexes[0] >= 0 && len(m.Attachments) > 0 {
+					comment.Attachment = m.Attachments[0].ID
+				}
+			}
+			pm := database.PostManager{DB: db.Conn, Data: comment}
+			if err := pm.Create(); err != nil {
+				log.Printf("Cannot create new record in database! TG: %s. See error: %s", comment.Telegram, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"reposter/config"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// How many times crosspost is tried when Discord rate limits it
+const maxCrosspostAttempts = 5
+
+var (
+	announcementChannels   = make(map[string]bool)
+	announcementChannelsMu sync.Mutex
+)
+
+// DetectAnnouncementChannels remembers which of configured Discord channels are announcement ones
+func DetectAnnouncementChannels(conf *config.Config, dcbot *discordgo.Session) {
+	for _, dest := range conf.AllDestinations() {
+		ch, err := getChannel(dcbot, dest.ChannelID)
+		if err != nil {
+			log.Printf("Cannot get info of channel %s! See error: %s", dest.ChannelID, err.Error())
+			continue
+		}
+
+		isNews := ch.Type == discordgo.ChannelTypeGuildNews
+		announcementChannelsMu.Lock()
+		announcementChannels[dest.ChannelID] = isNews
+		announcementChannelsMu.Unlock()
+		if isNews {
+			log.Printf("Channel %s is announcement channel, crosspost: %t", dest.ChannelID, dest.ShouldCrosspost())
+		}
+	}
+}
+
+func isAnnouncementChannel(channelID string) bool {
+	announcementChannelsMu.Lock()
+	defer announcementChannelsMu.Unlock()
+
+	return announcementChannels[channelID]
+}
+
+// crosspost publishes messages sent to announcement channel to following servers.
+// Crossposts have own rate limit, so it waits as long as Discord asks and tries again.
+func crosspost(dcbot *discordgo.Session, channelID string, messageIDs []string) {
+	for _, id := range messageIDs {
+		for attempt := 1; ; attempt++ {
+			_, err := dcbot.ChannelMessageCrosspost(channelID, id, discordgo.WithRetryOnRatelimit(false))
+			if err == nil {
+				break
+			}
+
+			delay := retryAfter(err)
+			if delay == 0 || attempt == maxCrosspostAttempts {
+				log.Printf("Cannot crosspost message %s in channel %s! See error: %s", id, channelID, err.Error())
+				break
+			}
+			log.Printf("Crosspost of message %s is rate limited, next attempt in %s", id, delay)
+			time.Sleep(delay)
+		}
+	}
+}
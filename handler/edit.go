@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+
+	"reposter/config"
+	"reposter/database"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// messageEdit is a change of Discord message, nil fields are left as is
+type messageEdit struct {
+	Content     *string
+	Embeds      *[]*discordgo.MessageEmbed
+	Files       []*discordgo.File
+	Attachments *[]*discordgo.MessageAttachment
+}
+
+// setText replaces text of the message with text of the repost
+func (e *messageEdit) setText(r *repost) {
+	content := r.Content
+	e.Content = &content
+
+	embeds := append([]*discordgo.MessageEmbed{}, r.embeds()...)
+	e.Embeds = &embeds
+}
+
+// replaceAttachment replaces attachment of the post in the message with new file, other attachments are kept.
+// Returns IDs of kept attachments.
+func (e *messageEdit) replaceAttachment(dcbot *discordgo.Session, p *database.Post, file *media, data []byte) (map[string]struct{}, error) {
+	m, err := dcbot.ChannelMessage(p.MessageChannel(), p.Discord)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[string]struct{})
+	taken := make(map[string]struct{})
+	attachments := []*discordgo.MessageAttachment{}
+	for _, a := range m.Attachments {
+		if a.ID == p.Attachment {
+			continue
+		}
+		kept[a.ID] = struct{}{}
+		taken[a.Filename] = struct{}{}
+		attachments = append(attachments, &discordgo.MessageAttachment{ID: a.ID})
+	}
+
+	// New file is referenced by its index in files
+	name := uniqueFileName(file.Name, taken)
+	attachments = append(attachments, &discordgo.MessageAttachment{ID: "0", Filename: name})
+	e.Attachments = &attachments
+	e.Files = []*discordgo.File{
+		{
+			Name:        name,
+			ContentType: file.ContentType,
+			Reader:      bytes.NewReader(data),
+		},
+	}
+
+	return kept, nil
+}
+
+// editMessage applies the edit to repost sent by the bot or with webhook.
+// Reposts in forum posts and mirrored comments are edited in their thread.
+func editMessage(db *database.Database, dcbot *discordgo.Session, p *database.Post, e *messageEdit) (*discordgo.Message, error) {
+	if p.Webhook != "" {
+		return editWebhookMessage(db, dcbot, p, &discordgo.WebhookEdit{
+			Content:         e.Content,
+			Embeds:          e.Embeds,
+			Files:           e.Files,
+			Attachments:     e.Attachments,
+			AllowedMentions: noMentions(),
+		})
+	}
+
+	return dcbot.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:              p.Discord,
+		Channel:         p.MessageChannel(),
+		Content:         e.Content,
+		Embeds:          e.Embeds,
+		Files:           e.Files,
+		Attachments:     e.Attachments,
+		AllowedMentions: noMentions(),
+	})
+}
+
+// deleteRepost deletes the repost message sent by the bot or with webhook and forgets it
+func deleteRepost(db *database.Database, dcbot *discordgo.Session, p *database.Post) error {
+	var err error
+	if p.Webhook != "" {
+		wm := database.WebhookManager{
+			DB: db.Conn,
+			Data: &database.Webhook{
+				WebhookID: p.Webhook,
+			},
+		}
+		if err := wm.FindByWebhookID(); err != nil {
+			return fmt.Errorf("Cannot read webhook record in database! See error: %s", err.Error())
+		}
+		err = dcbot.WebhookMessageDelete(wm.Data.WebhookID, wm.Data.Token, p.Discord, withThread(p.Thread))
+	} else {
+		err = dcbot.ChannelMessageDelete(p.MessageChannel(), p.Discord)
+	}
+	if err != nil {
+		return err
+	}
+
+	pm := database.PostManager{DB: db.Conn, Data: p}
+	return pm.Delete()
+}
+
+// sendTextParts sends parts of the edited text which are not in messages of the repost yet.
+// Discord messages cannot be inserted, so they come after messages sent since the repost.
+func sendTextParts(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, chat *tgbotapi.Chat, posts []database.Post, first *database.Post, parts []*repost) {
+	stored, last := 0, 0
+	for i := range posts {
+		p := &posts[i]
+		if p.MessageChannel() != first.MessageChannel() {
+			continue
+		}
+		if isTextPart(p) {
+			stored++
+		}
+		if p.Part > last {
+			last = p.Part
+		}
+	}
+
+	for k := stored; k < len(parts); k++ {
+		m, wh, err := sendRepost(conf, db, client, tgbot, dcbot, first.Channel, first.Thread, chat, parts[k])
+		if err != nil {
+			log.Printf("Cannot send part of edited repost to channel %s! See error: %s", first.Channel, err.Error())
+			return
+		}
+
+		last++
+		p := &database.Post{
+			Telegram: first.Telegram,
+			Channel:  first.Channel,
+			Discord:  m.ID,
+			IsEmbed:  parts[k].Embed != nil,
+			Part:     last,
+			Chunk:    k,
+			Thread:   first.Thread,
+		}
+		if wh != nil {
+			p.Webhook = wh.WebhookID
+		}
+		pm := database.PostManager{DB: db.Conn, Data: p}
+		if err := pm.Create(); err != nil {
+			log.Printf("Cannot create new record in database! TG: %s. See error: %s", p.Telegram, err.Error())
+		}
+	}
+}
+
+// editReposts updates reposts of the edited post or mirrored comment in all channels.
+// Text is rendered and split the same way as for new posts, replaced media is uploaded again.
+func editReposts(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, msg *tgbotapi.Message) {
+	// Find Discord posts ids by Telegram post id
+	pm := database.PostManager{
+		DB: db.Conn,
+		Data: &database.Post{
+			Telegram: telegramPostID(msg),
+		},
+	}
+	posts, err := pm.FindAllByTelegramPost()
+	if err != nil {
+		log.Printf("Cannot read record in database! See error: %s", err.Error())
+		return
+	}
+
+	if len(posts) == 0 {
+		return
+	}
+
+	// Comments are mirrored one by one, even ones of album
+	isComment := !msg.Chat.IsChannel()
+
+	var text *repost
+	var file *media
+	if msg.MediaGroupID == "" || isComment {
+		text, file = renderRepost(conf, msg)
+		if text != nil && text.Embed != nil {
+			text.Preview = linkPreview(conf, client, msg, text.color())
+		}
+	} else {
+		file = getMedia(msg)
+		// Album text is taken from one of its posts, so edit of post without caption must not erase it
+		if msg.Caption != "" {
+			text = renderAlbumText(conf, msg)
+		}
+	}
+
+	var data []byte
+	for i := range posts {
+		p := &posts[i]
+		e := &messageEdit{}
+
+		// Text is kept in the first message and messages continuing it
+		var part *repost
+		if isTextPart(p) && text != nil {
+			r := text
+			// Keep link to the file that was too large to upload
+			if file != nil && p.Media == file.UniqueID && p.Attachment == "" {
+				r = r.withPlaceholder(&attachment{Name: file.Name, Size: file.Size, Link: telegramPostLink(msg), Language: conf.ChatLanguage(msg.Chat.ID, msg.Chat.UserName)})
+			}
+			if isComment {
+				r = r.withAuthor(commentAuthor(msg), p.Webhook != "")
+			} else if msg.ReplyToMessage != nil {
+				// Keep reply quote, reference of the Discord reply cannot be changed anyway
+				r = r.withReply(db, dcbot, p.Channel, msg, p.Webhook != "" || p.Thread != "")
+			}
+			parts := r.split()
+			if p.Chunk >= len(parts) {
+				// Text became shorter, its part is not needed anymore
+				if err := deleteRepost(db, dcbot, p); err != nil {
+					log.Printf("Cannot delete part of edited repost! See error: %s", err.Error())
+				}
+				continue
+			}
+			if p.Part == 0 {
+				sendTextParts(conf, db, client, tgbot, dcbot, msg.Chat, posts, p, parts)
+			}
+			part = parts[p.Chunk]
+			e.setText(part)
+		}
+
+		var kept map[string]struct{}
+		replaced := file != nil && p.Media != "" && p.Media != file.UniqueID
+		if replaced && file.Size > conf.Telegram.GetMaxDownloadSize() {
+			log.Printf("Replaced media of post %s is too large to download", p.Telegram)
+			replaced = false
+		}
+		if replaced {
+			if data == nil {
+				data, err = downloadFile(conf, client, tgbot, file.FileID)
+				if err != nil {
+					log.Printf("Cannot upload replaced media! %s", err.Error())
+					notifyError(tgbot, msg.Chat.ID, chatLocale(conf, msg.Chat).text("error_replaced_media", err.Error()))
+					return
+				}
+			}
+			if len(data) > channelUploadLimit(dcbot, p.Channel) {
+				log.Printf("Replaced media of post %s is too large for channel %s", p.Telegram, p.Channel)
+				replaced = false
+			} else if kept, err = e.replaceAttachment(dcbot, p, file, data); err != nil {
+				log.Printf("Cannot read repost to replace media! See error: %s", err.Error())
+				replaced = false
+			}
+		}
+
+		if e.Content == nil && e.Files == nil {
+			continue
+		}
+
+		// Edit it with id that we got
+		m, err := editMessage(db, dcbot, p, e)
+		if err != nil {
+			log.Printf("Cannot edit repost! See error: %s", err.Error())
+			continue
+		}
+
+		if part != nil {
+			p.IsEmbed = part.Embed != nil
+		}
+		if replaced {
+			p.Media = file.UniqueID
+			for _, a := range m.Attachments {
+				if _, ok := kept[a.ID]; !ok {
+					p.Attachment = a.ID
+				}
+			}
+		}
+		pm.Data = p
+		if err := pm.Save(); err != nil {
+			log.Printf("Cannot update record in database! See error: %s", err.Error())
+		}
+	}
+}
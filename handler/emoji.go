@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"reposter/config"
+	"reposter/tgapi"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Imported emoji are named after custom emoji ID, so they are found in the guild after restart
+const importedEmojiPrefix = "tg"
+
+// Discord limit of emoji image size
+const maxEmojiSize = 256 << 10
+
+// How long custom emoji which failed to import are shown as alt text without trying again
+const failedEmojiTTL = time.Hour
+
+var (
+	// Custom emoji ID to imported Discord emoji
+	importedEmoji       = make(map[string]string)
+	importedEmojiLoaded bool
+	// Custom emoji ID to time when import of it can be tried again
+	failedEmoji     = make(map[string]time.Time)
+	importedEmojiMu sync.Mutex
+)
+
+// discordEmoji returns Discord emoji shown instead of the custom emoji, from config or imported.
+// Empty if there is none.
+func discordEmoji(conf *config.Config, id string) string {
+	if e, ok := conf.Discord.Emoji[id]; ok {
+		return e
+	}
+
+	importedEmojiMu.Lock()
+	defer importedEmojiMu.Unlock()
+
+	return importedEmoji[id]
+}
+
+// customEmojiOf returns Discord emoji shown instead of custom emoji of the message by offset of their entities
+func customEmojiOf(conf *config.Config, msg *tgbotapi.Message) map[int]string {
+	result := make(map[int]string)
+	for offset, id := range tgapi.CustomEmojiIDs(msg) {
+		if e := discordEmoji(conf, id); e != "" {
+			result[offset] = e
+		}
+	}
+
+	return result
+}
+
+// isFailedEmoji reports that import of the custom emoji failed recently
+func isFailedEmoji(id string) bool {
+	importedEmojiMu.Lock()
+	defer importedEmojiMu.Unlock()
+
+	retry, ok := failedEmoji[id]
+	if ok && time.Now().After(retry) {
+		delete(failedEmoji, id)
+		return false
+	}
+
+	return ok
+}
+
+// failEmoji remembers custom emoji which import failed
+func failEmoji(ids ...string) {
+	importedEmojiMu.Lock()
+	defer importedEmojiMu.Unlock()
+
+	for _, id := range ids {
+		failedEmoji[id] = time.Now().Add(failedEmojiTTL)
+	}
+}
+
+// loadImportedEmoji reads emoji imported before from the guild, once
+func loadImportedEmoji(dcbot *discordgo.Session, guildID string) {
+	importedEmojiMu.Lock()
+	defer importedEmojiMu.Unlock()
+	if importedEmojiLoaded {
+		return
+	}
+
+	emoji, err := dcbot.GuildEmojis(guildID)
+	if err != nil {
+		log.Printf("Cannot get emoji of guild %s! See error: %s", guildID, err.Error())
+		return
+	}
+	for _, e := range emoji {
+		if strings.HasPrefix(e.Name, importedEmojiPrefix) {
+			importedEmoji[strings.TrimPrefix(e.Name, importedEmojiPrefix)] = e.MessageFormat()
+		}
+	}
+	importedEmojiLoaded = true
+}
+
+// importCustomEmoji uploads custom emoji of the message which have no Discord emoji yet to the guild from config.
+// Animated emoji are uploaded as their static thumbnails.
+func importCustomEmoji(conf *config.Config, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, msg *tgbotapi.Message) {
+	guildID := conf.Discord.ImportEmoji
+	ids := tgapi.CustomEmojiIDs(msg)
+	if guildID == "" || len(ids) == 0 {
+		return
+	}
+	loadImportedEmoji(dcbot, guildID)
+
+	var missing []string
+	seen := make(map[string]struct{})
+	for _, id := range ids {
+		if _, ok := seen[id]; ok || discordEmoji(conf, id) != "" || isFailedEmoji(id) {
+			continue
+		}
+		seen[id] = struct{}{}
+		missing = append(missing, id)
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	stickers, err := tgapi.GetCustomEmojiStickers(tgbot, missing)
+	if err != nil {
+		log.Printf("Cannot get custom emoji stickers! See error: %s", err.Error())
+		failEmoji(missing...)
+		return
+	}
+
+	imported := make(map[string]struct{}, len(missing))
+	for _, s := range stickers {
+		fileID := s.ImageFileID()
+		if fileID == "" {
+			continue
+		}
+		data, err := downloadFile(conf, client, tgbot, fileID)
+		if err != nil {
+			log.Printf("Cannot download custom emoji %s! See error: %s", s.CustomEmojiID, err.Error())
+			continue
+		}
+		if len(data) > maxEmojiSize {
+			continue
+		}
+
+		e, err := dcbot.GuildEmojiCreate(guildID, &discordgo.EmojiParams{
+			Name:  importedEmojiPrefix + s.CustomEmojiID,
+			Image: "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data),
+		})
+		if err != nil {
+			log.Printf("Cannot upload custom emoji %s to guild %s! See error: %s", s.CustomEmojiID, guildID, err.Error())
+			continue
+		}
+
+		importedEmojiMu.Lock()
+		importedEmoji[s.CustomEmojiID] = e.MessageFormat()
+		importedEmojiMu.Unlock()
+		imported[s.CustomEmojiID] = struct{}{}
+	}
+
+	// Emoji not imported are shown as alt text for a while, without trying again for every post
+	var failed []string
+	for _, id := range missing {
+		if _, ok := imported[id]; !ok {
+			failed = append(failed, id)
+		}
+	}
+	failEmoji(failed...)
+}
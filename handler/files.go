@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"reposter/config"
+	"reposter/tgapi"
+
+	embed "github.com/Clinet/discordgo-embed"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Discord limits of uploaded file size by server boost level
+const (
+	uploadLimit      = 10 << 20
+	uploadLimitTier2 = 50 << 20
+	uploadLimitTier3 = 100 << 20
+)
+
+// downloadMedia downloads file of the post unless it is larger than the bot can download
+// or than any Discord server accepts. Data of too large file is nil, it is linked instead of uploading.
+func downloadMedia(conf *config.Config, client *http.Client, tgbot *tgbotapi.BotAPI, msg *tgbotapi.Message, file *media) (*attachment, error) {
+	a := &attachment{
+		Name:        file.Name,
+		ContentType: file.ContentType,
+		Size:        file.Size,
+		Media:       file.UniqueID,
+		Link:        telegramPostLink(msg),
+		Language:    conf.ChatLanguage(msg.Chat.ID, msg.Chat.UserName),
+	}
+	if file.Size > conf.Telegram.GetMaxDownloadSize() || file.Size > uploadLimitTier3 {
+		return a, nil
+	}
+
+	data, err := downloadFile(conf, client, tgbot, file.FileID)
+	if err != nil {
+		return nil, err
+	}
+	a.Data = data
+	a.Size = len(data)
+
+	return a, nil
+}
+
+// channelUploadLimit returns size of the largest file that can be uploaded to the Discord channel
+func channelUploadLimit(dcbot *discordgo.Session, channelID string) int {
+	ch, err := getChannel(dcbot, channelID)
+	if err != nil {
+		return uploadLimit
+	}
+	g, err := dcbot.State.Guild(ch.GuildID)
+	if err != nil {
+		if g, err = dcbot.Guild(ch.GuildID); err != nil {
+			return uploadLimit
+		}
+	}
+
+	switch g.PremiumTier {
+	case discordgo.PremiumTier2:
+		return uploadLimitTier2
+	case discordgo.PremiumTier3:
+		return uploadLimitTier3
+	}
+
+	return uploadLimit
+}
+
+// placeholderEmbed links file too large for Discord to the Telegram post
+func placeholderEmbed(a *attachment, color int) *discordgo.MessageEmbed {
+	return &discordgo.MessageEmbed{
+		Title:       "📎 " + a.Name,
+		URL:         a.Link,
+		Description: localeOf(a.Language).text("file_too_large", float64(a.Size)/(1<<20)),
+		Color:       color,
+	}
+}
+
+// joinPlaceholders returns one embed linking files of all the placeholders
+func joinPlaceholders(placeholders []*discordgo.MessageEmbed) *discordgo.MessageEmbed {
+	links := make([]string, 0, len(placeholders))
+	for _, e := range placeholders {
+		links = append(links, fmt.Sprintf("[%s](%s)", tgapi.EntitiesToDiscordMarkdown(e.Title, nil), e.URL))
+	}
+
+	return &discordgo.MessageEmbed{
+		Description: strings.Join(links, "\n"),
+		Color:       placeholders[0].Color,
+	}
+}
+
+// withPlaceholder returns copy of the repost linking the file instead of uploading it
+func (r *repost) withPlaceholder(a *attachment) *repost {
+	result := *r
+	result.Placeholders = append(append([]*discordgo.MessageEmbed{}, r.Placeholders...), placeholderEmbed(a, r.color()))
+
+	return &result
+}
+
+// fitTo returns copy of the repost where files larger than the limit are replaced with placeholders.
+// Returns new index of every file, -1 for the replaced ones.
+func (r *repost) fitTo(limit int) (*repost, []int) {
+	result := *r
+	result.Files = nil
+	result.Placeholders = append([]*discordgo.MessageEmbed{}, r.Placeholders...)
+
+	indexes := make([]int, len(r.Files))
+	for i, a := range r.Files {
+		if a.Data != nil && len(a.Data) <= limit {
+			indexes[i] = len(result.Files)
+			result.Files = append(result.Files, a)
+			continue
+		}
+
+		indexes[i] = -1
+		result.Placeholders = append(result.Placeholders, placeholderEmbed(a, result.color()))
+		// Embed cannot show image which is not uploaded
+		if result.Embed != nil && result.Embed.Image != nil && result.Embed.Image.URL == "attachment://"+a.Name {
+			e := *result.Embed.MessageEmbed
+			e.Image = nil
+			result.Embed = &embed.Embed{MessageEmbed: &e}
+		}
+	}
+
+	return &result, indexes
+}
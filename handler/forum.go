@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"reposter/config"
+	"reposter/database"
+	"reposter/tgapi"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Discord limit of thread name length
+	maxThreadName = 100
+	// Discord limit of tags applied to forum post
+	maxAppliedTags = 5
+)
+
+// threadName makes forum post title from the first line of the post text, or from the chat title if there is no text
+func threadName(msgs []*tgbotapi.Message) string {
+	var name []rune
+	for _, msg := range msgs {
+		for _, line := range strings.Split(msg.Text+msg.Caption, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				name = []rune(line)
+				break
+			}
+		}
+		if len(name) > 0 {
+			break
+		}
+	}
+	if len(name) == 0 {
+		name = []rune(webhookName(msgs[0].Chat.Title))
+	}
+	if len(name) > maxThreadName {
+		name = append(name[:maxThreadName-1], '…')
+	}
+
+	return string(name)
+}
+
+// hashtags returns hashtags of the posts without #, in lower case
+func hashtags(msgs []*tgbotapi.Message) []string {
+	var result []string
+	for _, msg := range msgs {
+		text, entities := msg.Text, msg.Entities
+		if msg.Caption != "" {
+			text, entities = msg.Caption, msg.CaptionEntities
+		}
+		for _, e := range entities {
+			if e.Type == "hashtag" {
+				result = append(result, strings.ToLower(strings.TrimPrefix(tgapi.EntityText(text, e), "#")))
+			}
+		}
+	}
+
+	return result
+}
+
+// forumTags returns IDs of the forum channel tags matching hashtags of the posts.
+// Hashtags are mapped to tags with destination options, or matched with tag names if there are none.
+func forumTags(dcbot *discordgo.Session, dest *config.Destination, msgs []*tgbotapi.Message) []string {
+	tags := hashtags(msgs)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	ch, err := getChannel(dcbot, dest.ChannelID)
+	if err != nil {
+		return nil
+	}
+
+	mapping := make(map[string]string, len(dest.Tags))
+	for hashtag, tag := range dest.Tags {
+		mapping[strings.ToLower(hashtag)] = tag
+	}
+
+	var result []string
+	seen := make(map[string]struct{})
+	for _, name := range tags {
+		if len(dest.Tags) > 0 {
+			var ok bool
+			if name, ok = mapping[name]; !ok {
+				continue
+			}
+		}
+		for _, t := range ch.AvailableTags {
+			if t.ID != name && !strings.EqualFold(t.Name, name) {
+				continue
+			}
+			if _, ok := seen[t.ID]; !ok && len(result) < maxAppliedTags {
+				seen[t.ID] = struct{}{}
+				result = append(result, t.ID)
+			}
+		}
+	}
+
+	return result
+}
+
+// withThread makes webhook request to the message in the thread
+func withThread(threadID string) discordgo.RequestOption {
+	return func(cfg *discordgo.RequestConfig) {
+		if threadID == "" {
+			return
+		}
+		q := cfg.Request.URL.Query()
+		q.Set("thread_id", threadID)
+		cfg.Request.URL.RawQuery = q.Encode()
+	}
+}
+
+// startForumPost creates new post in the forum channel with the repost as its first message.
+// Returns the message, ID of the created thread is its channel ID.
+func startForumPost(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, dest *config.Destination, msgs []*tgbotapi.Message, r *repost) (*discordgo.Message, *database.Webhook, error) {
+	name := threadName(msgs)
+	tags := forumTags(dcbot, dest, msgs)
+
+	// Discord accepts polls from webhooks, but WebhookParams of discordgo v0.29.0 has no poll field,
+	// so polls are sent by the bot until the library is upgraded
+	if conf.Discord.UseWebhooks() && r.Poll == nil {
+		m, wh, err := sendWebhook(conf, db, client, tgbot, dcbot, dest.ChannelID, "", name, msgs[0].Chat, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		// WebhookParams of discordgo v0.29.0 has no applied tags either, so the thread is edited after creation
+		if len(tags) > 0 {
+			if _, err := dcbot.ChannelEditComplex(m.ChannelID, &discordgo.ChannelEdit{AppliedTags: &tags}); err != nil {
+				log.Printf("Cannot apply tags to forum post! See error: %s", err.Error())
+			}
+		}
+		return m, wh, nil
+	}
+
+	th, err := dcbot.ForumThreadStartComplex(dest.ChannelID, &discordgo.ThreadStart{
+		Name:        name,
+		AppliedTags: tags,
+	}, r.MessageSend())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The first message of forum post has the same ID as its thread
+	m, err := dcbot.ChannelMessage(th.ID, th.ID)
+	if err != nil {
+		return &discordgo.Message{ID: th.ID, ChannelID: th.ID}, nil, nil
+	}
+
+	return m, nil, nil
+}
@@ -1,11 +1,14 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"regexp"
+	"strconv"
 	"time"
 
 	"reposter/config"
@@ -41,35 +44,46 @@ func getAuthorSignature(msg *tgbotapi.Message) string {
 	return authorSignature
 }
 
-func getForwardedFrom(msg *tgbotapi.Message) string {
+func getForwardedFrom(l catalog, msg *tgbotapi.Message) string {
 	forwardedFrom := ""
 	if msg.ForwardFromChat != nil {
 		chatName := ""
 		if msg.ForwardFromChat.UserName != "" {
 			chatName = fmt.Sprintf(" (@%s)", msg.ForwardFromChat.UserName)
 		}
-		forwardedFrom = fmt.Sprintf("forwarded from «%s»%s", msg.ForwardFromChat.Title, chatName)
+		forwardedFrom = l.text("forwarded_from_chat", msg.ForwardFromChat.Title, chatName)
 	} else if msg.ForwardFrom != nil {
 		lastName := ""
 		if msg.ForwardFrom.LastName != "" {
 			lastName = " " + msg.ForwardFrom.LastName
 		}
-		forwardedFrom = fmt.Sprintf("forwarded from %s%s", msg.ForwardFrom.FirstName, lastName)
+		forwardedFrom = l.text("forwarded_from_user", msg.ForwardFrom.FirstName, lastName)
 	}
 
 	return forwardedFrom
 }
 
-func formatMessage(msg *tgbotapi.Message) string {
+// formatMessage returns text of repost without embed, as content template of the route tells if it has one
+func formatMessage(conf *config.Config, msg *tgbotapi.Message) string {
+	if t := routeTemplate(conf, msg); t != nil && t.Content != "" {
+		opts := markdownOptions(conf, msg)
+		text := tgapi.EntitiesToDiscordMarkdownWithOptions(msg.Text, msg.Entities, opts) +
+			tgapi.EntitiesToDiscordMarkdownWithOptions(msg.Caption, msg.CaptionEntities, opts)
+		if s, ok := executeTemplate(t.Content, newTemplateData(conf, msg, text)); ok {
+			return s
+		}
+	}
+
 	authorSignature := getAuthorSignature(msg)
-	forwardedFrom := getForwardedFrom(msg)
+	forwardedFrom := getForwardedFrom(chatLocale(conf, msg.Chat), msg)
 
 	linebreak := ""
 	if authorSignature != "" || forwardedFrom != "" {
 		linebreak = "\n\n"
 	}
 
-	return authorSignature + forwardedFrom + linebreak + msg.Caption + msg.Text
+	rewrite := linkRewriter(conf, msg)
+	return authorSignature + forwardedFrom + linebreak + rewriteText(msg.Caption, msg.CaptionEntities, rewrite) + rewriteText(msg.Text, msg.Entities, rewrite)
 }
 
 func getPostLink(msg *tgbotapi.Message) string {
@@ -82,44 +96,38 @@ func getPostLink(msg *tgbotapi.Message) string {
 	return result
 }
 
-func formatEmbed(msg *tgbotapi.Message) *embed.Embed {
-	forwardedFrom := getForwardedFrom(msg)
+// markdownOptions returns how entities of the post are converted: which are turned into links as route of its chat tells,
+// and Discord emoji shown instead of its custom emoji.
+func markdownOptions(conf *config.Config, msg *tgbotapi.Message) *tgapi.MarkdownOptions {
+	opts := &tgapi.MarkdownOptions{
+		Mentions: true,
+		Channel:  msg.Chat.UserName,
+		Emoji:    customEmojiOf(conf, msg),
+		Rewrite:  linkRewriter(conf, msg),
+	}
+	if r := conf.FindRoute(msg.Chat.ID, msg.Chat.UserName); r != nil {
+		opts.Mentions = r.ShouldLinkMentions()
+		opts.Hashtags = r.Hashtags
+	}
+
+	return opts
+}
+
+func formatEmbed(conf *config.Config, msg *tgbotapi.Message) *embed.Embed {
+	forwardedFrom := getForwardedFrom(chatLocale(conf, msg.Chat), msg)
 	authorSignature := getAuthorSignature(msg)
 	result := embed.NewEmbed().
 		//SetTitle(getAuthorSignature(msg) + getForwardedFrom(msg)).
 		SetFooter(authorSignature + forwardedFrom).
-		SetColor(0x30a3e6).
+		SetColor(embedColor).
 		Truncate()
 
-	// Hide Telegram internal links if forward source hidden by user
-	var textEntities, captionEntities []tgbotapi.MessageEntity
-	text, textCaption := msg.Text, msg.Caption
-	if forwardedFrom == "" && authorSignature == "" {
-		for _, e := range msg.Entities {
-			if e.IsTextLink() && e.URL[:13] == "https://t.me/" {
-				e.URL = "https://t.me/#link-hidden-in-discord"
-			}
-			textEntities = append(textEntities, e)
-		}
-		for _, e := range msg.CaptionEntities {
-			if e.IsTextLink() && e.URL[:13] == "https://t.me/" {
-				e.URL = "https://t.me/#link-hidden-in-discord"
-			}
-			captionEntities = append(captionEntities, e)
-		}
-	} else {
-		textEntities, captionEntities = msg.Entities, msg.CaptionEntities
-	}
-
-	text = tgapi.EntitiesToDiscordMarkdown(text, textEntities)
-	textCaption = tgapi.EntitiesToDiscordMarkdown(textCaption, captionEntities)
+	// Links are changed by rules of the route, e.g. Telegram internal links are hidden if forward source hidden by user
+	opts := markdownOptions(conf, msg)
+	text := tgapi.EntitiesToDiscordMarkdownWithOptions(msg.Text, msg.Entities, opts)
+	textCaption := tgapi.EntitiesToDiscordMarkdownWithOptions(msg.Caption, msg.CaptionEntities, opts)
 
-	// Hide Telegram internal links if forward source hidden by user
-	if forwardedFrom == "" && authorSignature == "" {
-		var re = regexp.MustCompile(`(https[:]//t[.]me/)[^\s]+\b`)
-		text = re.ReplaceAllString(text, `$1#link-hidden-in-discord`)
-		textCaption = re.ReplaceAllString(textCaption, `$1#link-hidden-in-discord`)
-	} else {
+	if !isAnonymous(msg) {
 		if link := getPostLink(msg); link != `` {
 			result.AddField(`—`, link).InlineAllFields()
 		}
@@ -127,11 +135,14 @@ func formatEmbed(msg *tgbotapi.Message) *embed.Embed {
 
 	// embed.SetDescription() truncates text at 2048, but actual limit is 4096
 	// https://discord.com/developers/docs/resources/channel#embed-limits
-	// For now TG text limit also 4096 so no need any truncations.
-	// https://core.telegram.org/bots/api#message
+	// Text with caption, reply quote and footer may exceed it, so too long repost is split when sent.
 	result.Description = text
 	result.Description += textCaption
 
+	if t := routeTemplate(conf, msg); t != nil {
+		applyTemplate(t, result, newTemplateData(conf, msg, text+textCaption))
+	}
+
 	if msg.ForwardDate == 0 {
 		embedSetTimestamp(result, msg.Date)
 	} else {
@@ -141,6 +152,18 @@ func formatEmbed(msg *tgbotapi.Message) *embed.Embed {
 	return result
 }
 
+// Color of repost embeds unless the route template sets another one
+const embedColor = 0x30a3e6
+
+// color returns color of the repost embed, so placeholders and previews match it
+func (r *repost) color() int {
+	if r.Embed != nil {
+		return r.Embed.Color
+	}
+
+	return embedColor
+}
+
 func isJustLink(msg *tgbotapi.Message) bool {
 	if len(msg.Entities) == 1 && msg.Entities[0].IsURL() && msg.Entities[0].Length == len(msg.Text) {
 		return true
@@ -148,263 +171,587 @@ func isJustLink(msg *tgbotapi.Message) bool {
 	return false
 }
 
-var LastMediaGroupID string
+// repost is a Discord message built from a Telegram post. It is built once and may be sent to several channels.
+type repost struct {
+	Content   string
+	Embed     *embed.Embed
+	Files     []*attachment
+	Reference *discordgo.MessageReference
+	Poll      *discordgo.Poll
+	// Name shown by webhook instead of the chat title
+	Username string
+	// Embeds linking files too large for Discord
+	Placeholders []*discordgo.MessageEmbed
+	// Embed previewing link of the post
+	Preview *discordgo.MessageEmbed
+}
 
-func HandleUpdate(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, u tgbotapi.Update) {
-	if u.ChannelPost != nil {
-		var m *discordgo.Message
+type attachment struct {
+	Name        string
+	ContentType string
+	// Nil if the file is too large to download
+	Data []byte
+	Size int
+	// Unique ID of the Telegram file
+	Media string
+	// Link to the Telegram post with the file
+	Link string
+	// Language of the route of the post, placeholder of the file is shown in it
+	Language string
+}
 
-		var fileID *string
-		var fileName string
-		var contentType string
-		embd := formatEmbed(u.ChannelPost)
-
-		// Send repost to Discord text channel
-		if u.ChannelPost.Text != "" {
-			var err error
-			// Post links as text to have preview
-			if isJustLink(u.ChannelPost) {
-				m, err = dcbot.ChannelMessageSend(conf.Discord.ChannelID, formatMessage(u.ChannelPost))
-			} else {
-				m, err = dcbot.ChannelMessageSendEmbed(conf.Discord.ChannelID, embd.MessageEmbed)
-			}
-			if err != nil {
-				log.Printf("Cannot repost your post! See error: %s", err.Error())
+// embeds returns all embeds of the message.
+// Placeholders not fitting the limit of embeds are joined into the last one.
+func (r *repost) embeds() []*discordgo.MessageEmbed {
+	var result []*discordgo.MessageEmbed
+	if r.Embed != nil {
+		result = append(result, r.Embed.MessageEmbed)
+	}
+	if r.Preview != nil {
+		result = append(result, r.Preview)
+	}
 
-				_, err2 := tgbot.Send(tgbotapi.NewMessage(u.ChannelPost.Chat.ID, err.Error()))
-				if err2 != nil {
-					log.Print("cannot send tg msg", err2)
-				}
-				return
-			}
-		} else if u.ChannelPost.Photo != nil {
-			if len(u.ChannelPost.Photo) > 0 {
-				p := u.ChannelPost.Photo
-				url, err := tgbot.GetFileDirectURL(p[len(u.ChannelPost.Photo)-1].FileID)
-				if err != nil {
-					log.Printf("Cannot get direct file URL! See error: %s", err.Error())
-					return
-				}
+	room := maxEmbeds - len(result)
+	if len(r.Placeholders) <= room {
+		return append(result, r.Placeholders...)
+	}
+	result = append(result, r.Placeholders[:room-1]...)
 
-				resp, err := client.Get(url)
-				if err != nil {
-					log.Printf("Cannot do GET request! See error: %s", err.Error())
-					return
-				}
-				defer resp.Body.Close()
+	return append(result, joinPlaceholders(r.Placeholders[room-1:]))
+}
 
-				fileName = "photo.jpg"
-				embd.SetImage("attachment://" + fileName)
+// noMentions returns allowed mentions of bridged messages. Texts and names of Telegram posts and comments
+// may have @everyone or role and user mentions, they must not ping anyone in Discord.
+func noMentions() *discordgo.MessageAllowedMentions {
+	return &discordgo.MessageAllowedMentions{}
+}
 
-				// Set "forwarded from" only for first message in media group
-				if LastMediaGroupID != "" && LastMediaGroupID == u.ChannelPost.MediaGroupID && embd != nil {
-					embd.SetFooter("")
-				}
+// MessageSend returns new message with fresh file readers, so it can be sent any number of times.
+func (r *repost) MessageSend() *discordgo.MessageSend {
+	ms := &discordgo.MessageSend{
+		Content:         r.Content,
+		Reference:       r.Reference,
+		Poll:            r.Poll,
+		AllowedMentions: noMentions(),
+	}
+	ms.Embeds = r.embeds()
+	for _, a := range r.Files {
+		ms.Files = append(ms.Files, &discordgo.File{
+			Name:        a.Name,
+			ContentType: a.ContentType,
+			Reader:      bytes.NewReader(a.Data),
+		})
+	}
 
-				m, err = dcbot.ChannelMessageSendComplex(
-					conf.Discord.ChannelID,
-					&discordgo.MessageSend{
-						Embed: embd.MessageEmbed,
-						//Content: formatMessage(u.ChannelPost),
-						Files: []*discordgo.File{
-							{
-								Name:        fileName,
-								ContentType: "image/jpeg",
-								Reader:      resp.Body,
-							},
-						},
-					},
-				)
-				if err != nil {
-					log.Printf("Cannot send file! See error: %s", err.Error())
-
-					_, err2 := tgbot.Send(tgbotapi.NewMessage(u.ChannelPost.Chat.ID, err.Error()))
-					if err2 != nil {
-						log.Print("cannot send tg msg", err2)
-					}
-					return
-				}
-			}
-		} else if u.ChannelPost.Document != nil {
-			fileID = &u.ChannelPost.Document.FileID
-			fileName = u.ChannelPost.Document.FileName
-			contentType = "application/octet-stream"
-		} else if u.ChannelPost.Video != nil {
-			fileID = &u.ChannelPost.Video.FileID
-			fileName = "video.mp4"
-			contentType = "video/mp4"
-			//embedSetVideo(embd, "attachment://" + fileName)
-		} else if u.ChannelPost.VideoNote != nil {
-			fileID = &u.ChannelPost.VideoNote.FileID
-			fileName = "videonote.mp4"
-			contentType = "video/mp4"
-			// Looks like embed videos not works anymore
-			//embedSetVideo(embd, "attachment://" + fileName)
-		} else if u.ChannelPost.Audio != nil {
-			fileID = &u.ChannelPost.Audio.FileID
-			fileName = u.ChannelPost.Audio.Performer + " - " + u.ChannelPost.Audio.Title + ".mp3"
-			contentType = "audio/mpeg"
-		} else if u.ChannelPost.Voice != nil {
-			fileID = &u.ChannelPost.Voice.FileID
-			fileName = "voice.ogg"
-			contentType = "audio/ogg"
-		} else if u.ChannelPost.Sticker != nil {
-			// Webp image loads as sticker without thumbnail
-			if u.ChannelPost.Sticker.Thumbnail != nil {
-				fileID = &u.ChannelPost.Sticker.Thumbnail.FileID
-				fileName = "sticker.jpg"
-				contentType = "image/jpeg"
-				embd.SetTitle(u.ChannelPost.Sticker.Emoji)
-				embd.SetImage("attachment://" + fileName)
-			}
-		} else if u.ChannelPost.Poll != nil {
-			explanation := ""
-			correctOption := make(map[int]string)
+	return ms
+}
 
-			embd.MessageEmbed.Description = fmt.Sprintf("Multiple answers: %v\n", u.ChannelPost.Poll.AllowsMultipleAnswers)
-			if !u.ChannelPost.Poll.IsClosed {
-				embd.MessageEmbed.Description += fmt.Sprintf("Poll is open.\n")
-			}
-			if u.ChannelPost.Poll.Type == "quiz" {
-				embd.MessageEmbed.Description += fmt.Sprintf("Mode: quiz.\n")
-				correctOption[u.ChannelPost.Poll.CorrectOptionID] = "✅"
-				explanation = "\nExplanation:\n> " + tgapi.EntitiesToDiscordMarkdown(u.ChannelPost.Poll.Explanation, u.ChannelPost.Poll.ExplanationEntities)
-			}
-			embd.MessageEmbed.Description += "\n" + u.ChannelPost.Poll.Question
-			options := "\n\n"
+// downloadFile downloads file from Bot API server, or reads it from disk if local server is used
+func downloadFile(conf *config.Config, client *http.Client, tgbot *tgbotapi.BotAPI, fileID string) ([]byte, error) {
+	file, err := tgbot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get direct file URL! Error: %s", err.Error())
+	}
 
-			for i, option := range u.ChannelPost.Poll.Options {
-				options += fmt.Sprintf(" • %s %s (%d)\n", correctOption[i], option.Text, option.VoterCount)
-			}
-			embd.MessageEmbed.Description += options
-			embd.MessageEmbed.Description += fmt.Sprintf("\nVotes: %d\n", u.ChannelPost.Poll.TotalVoterCount)
-			embd.MessageEmbed.Description += explanation
-
-			var err error
-			m, err = dcbot.ChannelMessageSendEmbed(conf.Discord.ChannelID, embd.MessageEmbed)
-			if err != nil {
-				log.Printf("Cannot repost your post! See error: %s", err.Error())
-
-				_, err2 := tgbot.Send(tgbotapi.NewMessage(u.ChannelPost.Chat.ID, err.Error()))
-				if err2 != nil {
-					log.Print("cannot send tg msg", err2)
-				}
-				return
+	// Local server returns absolute path of the file
+	if conf.Telegram.Local {
+		data, err := ioutil.ReadFile(file.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read file! See error: %s", err.Error())
+		}
+		return data, nil
+	}
+
+	return fetch(client, fmt.Sprintf(conf.Telegram.GetFileEndpoint(), tgbot.Token, file.FilePath))
+}
+
+// fetch downloads file by URL
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot do GET request! See error: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot download file! Status: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read file! See error: %s", err.Error())
+	}
+
+	return data, nil
+}
+
+// formatPoll renders current results of the poll. Correct answer of quiz and its explanation are revealed when it is closed.
+func formatPoll(l catalog, embd *embed.Embed, poll *tgbotapi.Poll) {
+	explanation := ""
+	correctOption := make(map[int]string)
+
+	multiple := l.text("poll_no")
+	if poll.AllowsMultipleAnswers {
+		multiple = l.text("poll_yes")
+	}
+	embd.MessageEmbed.Description = l.text("poll_multiple") + " " + multiple + "\n"
+	if !poll.IsClosed {
+		embd.MessageEmbed.Description += l.text("poll_open") + "\n"
+	} else {
+		embd.MessageEmbed.Description += l.text("poll_closed") + "\n"
+	}
+	if poll.Type == "quiz" {
+		embd.MessageEmbed.Description += l.text("poll_quiz") + "\n"
+		if poll.IsClosed {
+			correctOption[poll.CorrectOptionID] = "✅"
+			if poll.Explanation != "" {
+				explanation = "\n" + l.text("poll_explanation") + "\n> " + tgapi.EntitiesToDiscordMarkdown(poll.Explanation, poll.ExplanationEntities)
 			}
 		}
+	}
+	embd.MessageEmbed.Description += "\n" + poll.Question
+	options := "\n\n"
+
+	for i, option := range poll.Options {
+		options += fmt.Sprintf(" • %s %s (%d)\n", correctOption[i], option.Text, option.VoterCount)
+	}
+	embd.MessageEmbed.Description += options
+	embd.MessageEmbed.Description += "\n" + l.text("poll_votes", poll.TotalVoterCount) + "\n"
+	embd.MessageEmbed.Description += explanation
+}
+
+// media is a file attached to the Telegram post
+type media struct {
+	FileID string
+	// Unique ID stays the same for the same file, used to detect replaced media
+	UniqueID    string
+	Name        string
+	ContentType string
+	// Size in bytes, 0 if unknown
+	Size int
+}
 
-		// If description is empty then no need embed
-		if embd.MessageEmbed.Description == "" && embd.MessageEmbed.Image == nil {
-			embd = nil
+// getMedia returns file of the post to upload to Discord, nil if there is no file.
+// Media under spoiler is hidden in Discord as well.
+func getMedia(msg *tgbotapi.Message) *media {
+	file := getFile(msg)
+	if file != nil && tgapi.HasMediaSpoiler(msg) {
+		file.Name = "SPOILER_" + file.Name
+	}
+
+	return file
+}
+
+func getFile(msg *tgbotapi.Message) *media {
+	if len(msg.Photo) > 0 {
+		p := msg.Photo[len(msg.Photo)-1]
+		return &media{p.FileID, p.FileUniqueID, "photo.jpg", "image/jpeg", p.FileSize}
+	} else if msg.Document != nil {
+		return &media{msg.Document.FileID, msg.Document.FileUniqueID, msg.Document.FileName, "application/octet-stream", msg.Document.FileSize}
+	} else if msg.Video != nil {
+		// Looks like embed videos not works anymore, so videos are just attached
+		//embedSetVideo(embd, "attachment://" + fileName)
+		return &media{msg.Video.FileID, msg.Video.FileUniqueID, "video.mp4", "video/mp4", msg.Video.FileSize}
+	} else if msg.VideoNote != nil {
+		return &media{msg.VideoNote.FileID, msg.VideoNote.FileUniqueID, "videonote.mp4", "video/mp4", msg.VideoNote.FileSize}
+	} else if msg.Audio != nil {
+		return &media{msg.Audio.FileID, msg.Audio.FileUniqueID, msg.Audio.Performer + " - " + msg.Audio.Title + ".mp3", "audio/mpeg", msg.Audio.FileSize}
+	} else if msg.Voice != nil {
+		return &media{msg.Voice.FileID, msg.Voice.FileUniqueID, "voice.ogg", "audio/ogg", msg.Voice.FileSize}
+	} else if msg.Sticker != nil && msg.Sticker.Thumbnail != nil {
+		// Webp image loads as sticker without thumbnail
+		return &media{msg.Sticker.Thumbnail.FileID, msg.Sticker.Thumbnail.FileUniqueID, "sticker.jpg", "image/jpeg", msg.Sticker.Thumbnail.FileSize}
+	}
+
+	return nil
+}
+
+// renderRepost builds Discord message from Telegram post without downloading its media.
+// Returns nil if the post type is not supported.
+func renderRepost(conf *config.Config, msg *tgbotapi.Message) (*repost, *media) {
+	embd := formatEmbed(conf, msg)
+	file := getMedia(msg)
+
+	if msg.Text != "" {
+		// Post links as text to have preview
+		if isJustLink(msg) {
+			return &repost{Content: formatMessage(conf, msg)}, nil
+		}
+	} else if len(msg.Photo) > 0 {
+		// Embed images cannot be hidden, so spoilered photo is just attached
+		if !tgapi.HasMediaSpoiler(msg) {
+			embd.SetImage("attachment://" + file.Name)
 		}
+	} else if msg.Sticker != nil {
+		if file == nil {
+			return nil, nil
+		}
+		embd.SetTitle(msg.Sticker.Emoji)
+		embd.SetImage("attachment://" + file.Name)
+	} else if msg.Poll != nil {
+		formatPoll(chatLocale(conf, msg.Chat), embd, msg.Poll)
+	} else if file == nil {
+		return nil, nil
+	}
 
-		// Set "forwarded from" only for first message in media group
-		if LastMediaGroupID != "" && LastMediaGroupID == u.ChannelPost.MediaGroupID && embd != nil {
-			embd.SetFooter("")
+	// If description is empty then no need embed
+	if embd.MessageEmbed.Description == "" && embd.MessageEmbed.Image == nil {
+		embd = nil
+	}
+
+	r := &repost{
+		Embed: embd,
+	}
+	if embd == nil {
+		r.Content = formatMessage(conf, msg)
+	}
+
+	return r, file
+}
+
+// newRepost builds Discord message from Telegram post and downloads its media.
+// Returns nil if the post type is not supported.
+func newRepost(conf *config.Config, client *http.Client, tgbot *tgbotapi.BotAPI, msg *tgbotapi.Message) (*repost, error) {
+	r, file := renderRepost(conf, msg)
+	if r == nil {
+		return nil, nil
+	}
+	if r.Embed != nil {
+		r.Preview = linkPreview(conf, client, msg, r.color())
+	}
+
+	if file != nil {
+		a, err := downloadMedia(conf, client, tgbot, msg, file)
+		if err != nil {
+			return nil, err
 		}
-		LastMediaGroupID = u.ChannelPost.MediaGroupID
+		r.Files = []*attachment{a}
+	}
 
-		if fileID != nil {
-			url, err := tgbot.GetFileDirectURL(*fileID)
-			if err != nil {
-				errr := fmt.Errorf("Cannot get direct file URL! Error: %s", err.Error())
-				log.Print(errr)
+	return r, nil
+}
 
-				_, err2 := tgbot.Send(tgbotapi.NewMessage(u.ChannelPost.Chat.ID, errr.Error()))
-				if err2 != nil {
-					log.Print("cannot send tg msg", err2)
-				}
-				return
-			}
+// getChannel returns the Discord channel from state cache, asking Discord API if it is not cached
+func getChannel(dcbot *discordgo.Session, channelID string) (*discordgo.Channel, error) {
+	if ch, err := dcbot.State.Channel(channelID); err == nil {
+		return ch, nil
+	}
 
-			resp, err := client.Get(url)
-			if err != nil {
-				errr := fmt.Errorf("Cannot do GET request! See error: %s", err.Error())
-				log.Print(errr)
+	return dcbot.Channel(channelID)
+}
 
-				_, err2 := tgbot.Send(tgbotapi.NewMessage(u.ChannelPost.Chat.ID, errr.Error()))
-				if err2 != nil {
-					log.Print("cannot send tg msg", err2)
-				}
-				return
-			}
-			defer resp.Body.Close()
-
-			files := []*discordgo.File{
-				{
-					Name:        fileName,
-					ContentType: contentType,
-					Reader:      resp.Body,
-				},
+// telegramPostID returns ID of the post as it stored in database
+func telegramPostID(msg *tgbotapi.Message) string {
+	return fmt.Sprintf("%d,%d", msg.Chat.ID, msg.MessageID)
+}
+
+// sendRepost sends repost to the Discord channel by the bot or with webhook depending on config.
+// Webhook is nil if the message was sent by the bot.
+func sendRepost(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, channelID, threadID string, chat *tgbotapi.Chat, r *repost) (*discordgo.Message, *database.Webhook, error) {
+	// Discord accepts polls from webhooks, but WebhookParams of discordgo v0.29.0 has no poll field,
+	// so polls are sent by the bot until the library is upgraded
+	if conf.Discord.UseWebhooks() && r.Poll == nil {
+		return sendWebhook(conf, db, client, tgbot, dcbot, channelID, threadID, "", chat, r)
+	}
+
+	if threadID != "" {
+		channelID = threadID
+	}
+	m, err := dcbot.ChannelMessageSendComplex(channelID, r.MessageSend())
+
+	return m, nil, err
+}
+
+// deleteMessage deletes message sent to Discord channel by the bot or with webhook
+func deleteMessage(dcbot *discordgo.Session, channelID string, m *discordgo.Message, wh *database.Webhook) error {
+	if wh != nil {
+		return dcbot.WebhookMessageDelete(wh.WebhookID, wh.Token, m.ID)
+	}
+
+	return dcbot.ChannelMessageDelete(channelID, m.ID)
+}
+
+// placement tells which of Discord messages holds file of the post
+type placement struct {
+	Part int
+	// Index in files of the message, -1 if the post has no file
+	File int
+}
+
+// buildReposts builds Discord messages for the post or posts of album.
+// Returns placement of every post file, nil if posts are not supported.
+func buildReposts(conf *config.Config, client *http.Client, tgbot *tgbotapi.BotAPI, msgs []*tgbotapi.Message) ([]*repost, []placement, error) {
+	if len(msgs) == 1 && msgs[0].Poll != nil && conf.Discord.UseNativePolls() {
+		if r := newPollRepost(conf, msgs[0]); r != nil {
+			return []*repost{r}, []placement{{0, -1}}, nil
+		}
+	}
+
+	if len(msgs) == 1 && msgs[0].MediaGroupID == "" {
+		r, err := newRepost(conf, client, tgbot, msgs[0])
+		if r == nil || err != nil {
+			return nil, nil, err
+		}
+		place := placement{0, -1}
+		if len(r.Files) > 0 {
+			place.File = 0
+		}
+		return []*repost{r}, []placement{place}, nil
+	}
+
+	return newAlbumReposts(conf, client, tgbot, msgs)
+}
+
+// sendReposts sends messages built for the posts to the Discord channel and links them in database.
+// Every post is linked with the first message to edit the text, with messages continuing too long text,
+// and with the message holding its file.
+// In forum channel the first message starts new forum post and the rest are sent to its thread.
+// If one of messages cannot be sent, already sent ones are deleted, so posts can be sent again from scratch.
+func sendReposts(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, dest *config.Destination, msgs []*tgbotapi.Message, reposts []*repost, places []placement) error {
+	channelID := dest.ChannelID
+	chat := msgs[0].Chat
+	// Files too large for the channel are linked instead
+	limit := channelUploadLimit(dcbot, channelID)
+	indexes := make([][]int, len(reposts))
+	// Reposts too long for Discord are split, every repost starts at its first message
+	var messages []*repost
+	var chunks []int
+	firsts := make([]int, len(reposts))
+	for i, r := range reposts {
+		r, indexes[i] = r.fitTo(limit)
+		// Reply to repost of replied post, found separately in every channel
+		if i == 0 && msgs[0].ReplyToMessage != nil {
+			r = r.withReply(db, dcbot, channelID, msgs[0], conf.Discord.UseWebhooks() || dest.IsForum())
+		}
+		firsts[i] = len(messages)
+		for k, part := range r.split() {
+			messages = append(messages, part)
+			chunks = append(chunks, k)
+		}
+	}
+
+	sent := make([]*discordgo.Message, 0, len(messages))
+	var wh *database.Webhook
+	thread := ""
+	for i, r := range messages {
+		var m *discordgo.Message
+		var w *database.Webhook
+		var err error
+		if i == 0 && dest.IsForum() {
+			m, w, err = startForumPost(conf, db, client, tgbot, dcbot, dest, msgs, r)
+			if err == nil {
+				thread = m.ChannelID
 			}
-			var messageSend *discordgo.MessageSend
-			if embd == nil {
-				messageSend = &discordgo.MessageSend{
-					Content: formatMessage(u.ChannelPost),
-					Files:   files,
+		} else {
+			m, w, err = sendRepost(conf, db, client, tgbot, dcbot, channelID, thread, chat, r)
+		}
+		if err != nil {
+			if thread != "" {
+				// Deleting the thread deletes all its messages
+				if _, err := dcbot.ChannelDelete(thread); err != nil {
+					log.Printf("Cannot delete partially sent forum post! See error: %s", err.Error())
 				}
 			} else {
-				messageSend = &discordgo.MessageSend{
-					Embed: embd.MessageEmbed,
-					Files: files,
+				for _, m := range sent {
+					if err := deleteMessage(dcbot, channelID, m, wh); err != nil {
+						log.Printf("Cannot delete partially sent repost! See error: %s", err.Error())
+					}
 				}
 			}
-			m, err = dcbot.ChannelMessageSendComplex(
-				conf.Discord.ChannelID,
-				messageSend,
-			)
-			if err != nil {
-				errr := fmt.Errorf("Cannot send file! See error: %s", err.Error())
-				log.Print(errr)
-
-				_, err2 := tgbot.Send(tgbotapi.NewMessage(u.ChannelPost.Chat.ID, errr.Error()))
-				if err2 != nil {
-					log.Print("cannot send tg msg", err2)
-				}
+			return fmt.Errorf("Cannot repost your post to channel %s! See error: %w", channelID, err)
+		}
+		sent = append(sent, m)
+		wh = w
+	}
+
+	for i, msg := range msgs {
+		posts := []*database.Post{
+			{
+				Telegram: telegramPostID(msg),
+				Channel:  channelID,
+				Discord:  sent[0].ID,
+				IsEmbed:  messages[0].Embed != nil,
+			},
+		}
+		// Poll results are updated when they change
+		if msg.Poll != nil {
+			posts[0].Poll = msg.Poll.ID
+		}
+		// Text is continued right after the first message
+		for j := 1; j < len(messages) && chunks[j] > 0; j++ {
+			posts = append(posts, &database.Post{
+				Telegram: telegramPostID(msg),
+				Channel:  channelID,
+				Discord:  sent[j].ID,
+				IsEmbed:  messages[j].Embed != nil,
+				Part:     j,
+				Chunk:    chunks[j],
+			})
+		}
+		place := places[i]
+		part := firsts[place.Part]
+		holder := posts[0]
+		if part != 0 {
+			holder = &database.Post{
+				Telegram: telegramPostID(msg),
+				Channel:  channelID,
+				Discord:  sent[part].ID,
+				Part:     part,
+			}
+			posts = append(posts, holder)
+		}
+		// Remember the file to replace it when media of the post edited
+		if place.File >= 0 {
+			holder.Media = reposts[place.Part].Files[place.File].Media
+			if j, atts := indexes[place.Part][place.File], sent[part].Attachments; j >= 0 && j < len(atts) {
+				holder.Attachment = atts[j].ID
 			}
 		}
 
-		if m != nil {
-			// Save new record with ids from Telegram and Discord
-			pm := database.PostManager{
-				DB: db.Conn,
-				Data: &database.Post{
-					Telegram: fmt.Sprintf("%d,%d", u.ChannelPost.Chat.ID, u.ChannelPost.MessageID),
-					Discord:  m.ID,
-					IsEmbed:  embd != nil,
-				},
+		for _, p := range posts {
+			if wh != nil {
+				p.Webhook = wh.WebhookID
 			}
+			p.Thread = thread
+			pm := database.PostManager{DB: db.Conn, Data: p}
 			if err := pm.Create(); err != nil {
-				log.Printf("Cannot create new record in database! TG: %s. gSee error: %s", err.Error(), pm.Data.Telegram)
+				log.Printf("Cannot create new record in database! TG: %s. See error: %s", p.Telegram, err.Error())
 			}
 		}
-	} else if u.EditedChannelPost != nil {
-		// Find Discord post id by Telegram post id
-		pm := database.PostManager{
-			DB: db.Conn,
-			Data: &database.Post{
-				Telegram: fmt.Sprintf("%d,%d", u.EditedChannelPost.Chat.ID, u.EditedChannelPost.MessageID),
-			},
+	}
+
+	// Publishing may wait for rate limit for long, repost is done anyway
+	if dest.ShouldCrosspost() && isAnnouncementChannel(channelID) {
+		ids := make([]string, len(sent))
+		for i, m := range sent {
+			ids[i] = m.ID
 		}
-		err := pm.FindByTelegramPost()
-		if err != nil {
-			log.Printf("Cannot read record in database! See error: %s", err.Error())
+		go crosspost(dcbot, channelID, ids)
+	}
+
+	return nil
+}
+
+// deliver reposts posts to the Discord channels. Failed reposts are put into outbox to retry later.
+func deliver(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, dests []*config.Destination, msgs []*tgbotapi.Message) {
+	reposts, places, err := buildReposts(conf, client, tgbot, msgs)
+	if err != nil {
+		log.Print(err)
+		for _, dest := range dests {
+			enqueue(conf, db, dest.ChannelID, msgs, err)
+		}
+		return
+	}
+	if reposts == nil {
+		return
+	}
+
+	// Send repost to every Discord channel of the route
+	for _, dest := range dests {
+		if err := sendReposts(conf, db, client, tgbot, dcbot, dest, msgs, reposts, places); err != nil {
+			log.Print(err)
+			enqueue(conf, db, dest.ChannelID, msgs, err)
+		}
+	}
+}
+
+// notifyError reports the error to the Telegram chat where the post came from
+func notifyError(tgbot *tgbotapi.BotAPI, chatID int64, text string) {
+	_, err2 := tgbot.Send(tgbotapi.NewMessage(chatID, text))
+	if err2 != nil {
+		log.Print("cannot send tg msg", err2)
+	}
+}
+
+// RejectedUpdates counts updates dropped because they came from not allowed chats, by chat ID
+var RejectedUpdates = expvar.NewMap("rejected_updates")
+
+// isAllowed checks that the update came from allowed chat, otherwise logs it and leaves the chat if configured.
+// Private chats are always allowed.
+func isAllowed(conf *config.Config, tgbot *tgbotapi.BotAPI, u *tgbotapi.Update) bool {
+	chat := u.FromChat()
+	if chat == nil && u.MyChatMember != nil {
+		chat = &u.MyChatMember.Chat
+	}
+	if chat == nil || chat.IsPrivate() || conf.IsChatAllowed(chat.ID, chat.UserName) {
+		return true
+	}
+	// Comments come from discussion group linked to the channel
+	if isDiscussionOf(conf, tgbot, chat) {
+		return true
+	}
+
+	RejectedUpdates.Add(strconv.FormatInt(chat.ID, 10), 1)
+	log.Printf("Update %d from not allowed chat %d «%s» (@%s) ignored", u.UpdateID, chat.ID, chat.Title, chat.UserName)
+
+	if conf.Telegram.LeaveUnknownChats {
+		if _, err := tgbot.Request(tgbotapi.LeaveChatConfig{ChatID: chat.ID}); err != nil {
+			log.Printf("Cannot leave chat %d! See error: %s", chat.ID, err.Error())
+		} else {
+			log.Printf("Left not allowed chat %d", chat.ID)
+		}
+	}
+
+	return false
+}
+
+func HandleUpdate(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, u tgbotapi.Update) {
+	if !isAllowed(conf, tgbot, &u) {
+		return
+	}
+
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+	// Albums still waiting for their posts go before anything that came after them
+	except := ""
+	if u.ChannelPost != nil && u.ChannelPost.MediaGroupID != "" {
+		except = albumKey(u.ChannelPost)
+	}
+	flushAlbums(except)
+
+	for _, msg := range []*tgbotapi.Message{u.ChannelPost, u.EditedChannelPost, u.Message, u.EditedMessage} {
+		if msg != nil {
+			importCustomEmoji(conf, client, tgbot, dcbot, msg)
+		}
+	}
+
+	if u.ChannelPost != nil {
+		// Posts from Discord must not go back
+		if isReverseMirror(db, u.ChannelPost) {
 			return
 		}
 
-		// Edit it with id that we got
-		if u.EditedChannelPost.Text != "" || u.EditedChannelPost.Caption != "" {
-			if pm.Data.IsEmbed {
-				_, err = dcbot.ChannelMessageEditEmbed(conf.Discord.ChannelID, pm.Data.Discord, formatEmbed(u.EditedChannelPost).MessageEmbed)
-			} else {
-				_, err = dcbot.ChannelMessageEdit(conf.Discord.ChannelID, pm.Data.Discord, u.EditedChannelPost.Caption+u.EditedChannelPost.Text)
-			}
-			if err != nil {
-				log.Printf("Cannot edit repost! See error: %s", err.Error())
-			}
+		dests := conf.Destinations(u.ChannelPost.Chat.ID, u.ChannelPost.Chat.UserName)
+		if len(dests) == 0 {
+			log.Printf("No Discord channels configured for chat %d (@%s)", u.ChannelPost.Chat.ID, u.ChannelPost.Chat.UserName)
+			return
 		}
+
+		// Posts of album are sent together when all of them received
+		if u.ChannelPost.MediaGroupID != "" {
+			bufferAlbum(u.ChannelPost, func(msgs []*tgbotapi.Message) {
+				deliver(conf, db, client, tgbot, dcbot, dests, msgs)
+			})
+			return
+		}
+
+		deliver(conf, db, client, tgbot, dcbot, dests, []*tgbotapi.Message{u.ChannelPost})
+	} else if u.Poll != nil {
+		updatePoll(conf, db, dcbot, u.Poll)
+	} else if u.EditedChannelPost != nil {
+		editReposts(conf, db, client, tgbot, dcbot, u.EditedChannelPost)
+	} else if u.EditedMessage != nil && linkedChannel(tgbot, u.EditedMessage.Chat) != nil {
+		editReposts(conf, db, client, tgbot, dcbot, u.EditedMessage)
+	} else if u.Message != nil && linkedChannel(tgbot, u.Message.Chat) != nil {
+		// Discussion group of the channel, comments are mirrored to threads of reposts
+		mirrorComment(conf, db, client, tgbot, dcbot, u.Message)
 	} else if u.Message != nil {
-		msg := tgbotapi.NewMessage(u.Message.Chat.ID, "Я просто бот. Какая тебе разница, чем я занят?")
+		// Bot always replied in Russian before languages were added, so it still does unless language is set
+		language := conf.Language
+		if language == "" {
+			language = "ru"
+		}
+		msg := tgbotapi.NewMessage(u.Message.Chat.ID, localeOf(language).text("bot_reply"))
 		tgbot.Send(msg)
 	}
 }
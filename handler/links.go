@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf16"
+
+	"reposter/config"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Fragment hidden links lead to instead of their path
+const hiddenLink = "#link-hidden-in-discord"
+
+// isAnonymous reports that the post has neither author signature nor forward source
+func isAnonymous(msg *tgbotapi.Message) bool {
+	return msg.AuthorSignature == "" && msg.ForwardFromChat == nil && msg.ForwardFrom == nil
+}
+
+// matchDomain reports that the host is the domain or its subdomain, empty domain matches any host
+func matchDomain(host, domain string) bool {
+	host, domain = strings.ToLower(host), strings.ToLower(strings.TrimPrefix(domain, "."))
+
+	return domain == "" || host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// isTracking reports that the query parameter is one of the stripped ones
+func isTracking(param string, params []string) bool {
+	for _, p := range params {
+		if p == param || strings.HasSuffix(p, "*") && strings.HasPrefix(param, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewriteLink applies the rules to the link. Anonymous tells that the post has no signature and forward.
+// Links without scheme, as Telegram finds them in text, stay without it.
+func rewriteLink(rules []*config.LinkRule, anonymous bool, link string) string {
+	noScheme := !strings.Contains(link, "://")
+	raw := link
+	if noScheme {
+		raw = "https://" + link
+	}
+	u, err := url.Parse(raw)
+	if link == "" || err != nil || u.Host == "" {
+		return link
+	}
+
+	changed := false
+rules:
+	for _, rule := range rules {
+		if rule.Anonymous && !anonymous || !matchDomain(u.Hostname(), rule.Domain) {
+			continue
+		}
+
+		switch rule.Action {
+		case config.LinkHide:
+			return u.Scheme + "://" + u.Host + "/" + hiddenLink
+		case config.LinkKeep:
+			break rules
+		case config.LinkStrip:
+			query := u.Query()
+			stripped := false
+			for param := range query {
+				if isTracking(param, rule.GetParams()) {
+					query.Del(param)
+					stripped = true
+				}
+			}
+			// Encoding reorders and escapes the query, so it is kept as is if nothing is stripped
+			if stripped {
+				u.RawQuery = query.Encode()
+				changed = true
+			}
+		case config.LinkRewrite:
+			if rule.To != "" && u.Host != rule.To {
+				u.Host = rule.To
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return link
+	}
+
+	if noScheme {
+		return strings.TrimPrefix(u.String(), "https://")
+	}
+
+	return u.String()
+}
+
+// linkRewriter returns function applying link rules of the post route to its links
+func linkRewriter(conf *config.Config, msg *tgbotapi.Message) func(string) string {
+	rules := conf.LinkRules(msg.Chat.ID, msg.Chat.UserName)
+	anonymous := isAnonymous(msg)
+
+	return func(link string) string {
+		return rewriteLink(rules, anonymous, link)
+	}
+}
+
+// rewriteText applies the rewrite to URLs shown in the plain text
+func rewriteText(text string, entities []tgbotapi.MessageEntity, rewrite func(string) string) string {
+	src := utf16.Encode([]rune(text))
+	var result strings.Builder
+	pos := 0
+	for _, e := range entities {
+		end := e.Offset + e.Length
+		if !e.IsURL() || e.Offset < pos || end > len(src) {
+			continue
+		}
+		result.WriteString(string(utf16.Decode(src[pos:e.Offset])))
+		result.WriteString(rewrite(string(utf16.Decode(src[e.Offset:end]))))
+		pos = end
+	}
+	result.WriteString(string(utf16.Decode(src[pos:])))
+
+	return result.String()
+}
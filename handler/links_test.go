@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"testing"
+
+	"reposter/config"
+)
+
+func TestRewriteLink(t *testing.T) {
+	defaultRules := (&config.Config{}).LinkRules(0, "")
+	cases := map[string]struct {
+		Rules     []*config.LinkRule
+		Anonymous bool
+		Link      string
+		Expected  string
+	}{
+		"default hide": {
+			Rules:     defaultRules,
+			Anonymous: true,
+			Link:      "https://t.me/channel/42",
+			Expected:  "https://t.me/#link-hidden-in-discord",
+		},
+		"default signed": {
+			Rules:    defaultRules,
+			Link:     "https://t.me/channel/42",
+			Expected: "https://t.me/channel/42",
+		},
+		"default other domain": {
+			Rules:     defaultRules,
+			Anonymous: true,
+			Link:      "https://example.com/t.me/42",
+			Expected:  "https://example.com/t.me/42",
+		},
+		"strip": {
+			Rules:    []*config.LinkRule{{Action: config.LinkStrip}},
+			Link:     "https://youtu.be/abc?si=xyz&t=42&utm_source=tg&utm_medium=post",
+			Expected: "https://youtu.be/abc?t=42",
+		},
+		"strip nothing": {
+			Rules:    []*config.LinkRule{{Action: config.LinkStrip}},
+			Link:     "https://example.com/?b=2&a=1&q=a+b",
+			Expected: "https://example.com/?b=2&a=1&q=a+b",
+		},
+		"rewrite then keep": {
+			Rules: []*config.LinkRule{
+				{Domain: "twitter.com", Action: config.LinkRewrite, To: "fxtwitter.com"},
+				{Domain: "fxtwitter.com", Action: config.LinkKeep},
+				{Action: config.LinkHide},
+			},
+			Link:     "https://twitter.com/user/status/42",
+			Expected: "https://fxtwitter.com/user/status/42",
+		},
+		"subdomain": {
+			Rules:    []*config.LinkRule{{Domain: "twitter.com", Action: config.LinkRewrite, To: "fxtwitter.com"}},
+			Link:     "https://mobile.twitter.com/user",
+			Expected: "https://fxtwitter.com/user",
+		},
+		"no scheme": {
+			Rules:    []*config.LinkRule{{Action: config.LinkStrip}},
+			Link:     "example.com/page?utm_source=tg&id=1",
+			Expected: "example.com/page?id=1",
+		},
+		"no scheme unchanged": {
+			Rules:    []*config.LinkRule{{Action: config.LinkStrip}},
+			Link:     "example.com/page",
+			Expected: "example.com/page",
+		},
+		"no scheme hide": {
+			Rules:     defaultRules,
+			Anonymous: true,
+			Link:      "t.me/channel/42",
+			Expected:  "https://t.me/#link-hidden-in-discord",
+		},
+	}
+
+	for name, c := range cases {
+		if link := rewriteLink(c.Rules, c.Anonymous, c.Link); link != c.Expected {
+			t.Errorf("%s: got %q, expected %q", name, link, c.Expected)
+		}
+	}
+}
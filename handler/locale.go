@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"reposter/config"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// catalog maps keys of user-facing texts to their translations, texts with arguments are fmt formats
+type catalog map[string]string
+
+// Message catalogs by language, English one has every text
+var catalogs = map[string]catalog{
+	"en": {
+		"forwarded_from_chat":  "forwarded from «%s»%s",
+		"forwarded_from_user":  "forwarded from %s%s",
+		"poll_multiple":        "Multiple answers:",
+		"poll_yes":             "true",
+		"poll_no":              "false",
+		"poll_open":            "Poll is open.",
+		"poll_closed":          "Poll is closed.",
+		"poll_quiz":            "Mode: quiz.",
+		"poll_explanation":     "Explanation:",
+		"poll_votes":           "Votes: %d",
+		"file_too_large":       "File is too large for Discord (%.1f MB), open it in Telegram.",
+		"error_replaced_media": "Cannot upload replaced media! %s",
+		"error_dead_letter":    "Repost %d to channel %s failed %d times and will not be retried! Last error: %s",
+		"bot_reply":            "I am just a bot. Why do you care what I am busy with?",
+	},
+	"ru": {
+		"forwarded_from_chat":  "переслано из «%s»%s",
+		"forwarded_from_user":  "переслано от %s%s",
+		"poll_multiple":        "Несколько ответов:",
+		"poll_yes":             "да",
+		"poll_no":              "нет",
+		"poll_open":            "Опрос открыт.",
+		"poll_closed":          "Опрос закрыт.",
+		"poll_quiz":            "Режим: викторина.",
+		"poll_explanation":     "Пояснение:",
+		"poll_votes":           "Голосов: %d",
+		"file_too_large":       "Файл слишком большой для Discord (%.1f МБ), откройте его в Telegram.",
+		"error_replaced_media": "Не удалось загрузить заменённый файл! %s",
+		"error_dead_letter":    "Репост %d в канал %s не удался %d раз и больше не будет повторяться! Последняя ошибка: %s",
+		"bot_reply":            "Я просто бот. Какая тебе разница, чем я занят?",
+	},
+}
+
+// localeOf returns catalog of the language, English one if there is no such language
+func localeOf(language string) catalog {
+	if c, ok := catalogs[language]; ok {
+		return c
+	}
+
+	return catalogs[config.DefaultLanguage]
+}
+
+// chatLocale returns catalog of the language of the Telegram chat route
+func chatLocale(conf *config.Config, chat *tgbotapi.Chat) catalog {
+	return localeOf(conf.ChatLanguage(chat.ID, chat.UserName))
+}
+
+// channelLocale returns catalog of the language of the Discord channel route
+func channelLocale(conf *config.Config, channelID string) catalog {
+	return localeOf(conf.ChannelLanguage(channelID))
+}
+
+// text returns translation of the text formatted with the arguments. English text is used if there is no translation.
+func (c catalog) text(key string, args ...interface{}) string {
+	format, ok := c[key]
+	if !ok {
+		format = catalogs[config.DefaultLanguage][key]
+	}
+	if len(args) == 0 {
+		return format
+	}
+
+	return fmt.Sprintf(format, args...)
+}
+
+// CheckLanguages reports languages set in config which have no message catalog
+func CheckLanguages(conf *config.Config) error {
+	for _, language := range conf.Languages() {
+		if _, ok := catalogs[language]; !ok {
+			var known []string
+			for l := range catalogs {
+				known = append(known, l)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown language %q, known ones are %s", language, strings.Join(known, ", "))
+		}
+	}
+
+	return nil
+}
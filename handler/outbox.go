@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"reposter/config"
+	"reposter/database"
+	"reposter/tgapi"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// How often outbox is checked for reposts to retry
+const outboxInterval = 10 * time.Second
+
+// retryAfter returns delay requested by Discord if the request was rate limited
+func retryAfter(err error) time.Duration {
+	var rlErr *discordgo.RateLimitError
+	if errors.As(err, &rlErr) && rlErr.TooManyRequests != nil {
+		return rlErr.RetryAfter
+	}
+
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusTooManyRequests {
+		var tmr discordgo.TooManyRequests
+		if json.Unmarshal(restErr.ResponseBody, &tmr) == nil {
+			return tmr.RetryAfter
+		}
+	}
+
+	return 0
+}
+
+// retryDelay returns exponential backoff for the attempt, but not less than Discord asks to wait
+func retryDelay(conf *config.Config, attempts int, err error) time.Duration {
+	delay := conf.Outbox.GetBackoff()
+	for i := 1; i < attempts && delay < conf.Outbox.GetMaxBackoff(); i++ {
+		delay *= 2
+	}
+	if delay > conf.Outbox.GetMaxBackoff() {
+		delay = conf.Outbox.GetMaxBackoff()
+	}
+	if ra := retryAfter(err); ra > delay {
+		delay = ra
+	}
+
+	return delay
+}
+
+// enqueue puts failed repost of the posts to the channel into outbox
+func enqueue(conf *config.Config, db *database.Database, channelID string, msgs []*tgbotapi.Message, err error) {
+	payload, jerr := json.Marshal(msgs)
+	if jerr != nil {
+		log.Printf("Cannot serialize posts for outbox! See error: %s", jerr.Error())
+		return
+	}
+	// Spoilers, custom emoji and link previews are forgotten after a while, so retry keeps them with posts
+	infos := make([]*tgapi.MessageInfo, 0, len(msgs))
+	for _, msg := range msgs {
+		infos = append(infos, tgapi.GetMessageInfo(msg))
+	}
+	info, jerr := json.Marshal(infos)
+	if jerr != nil {
+		log.Printf("Cannot serialize posts for outbox! See error: %s", jerr.Error())
+		return
+	}
+
+	om := database.OutboxManager{
+		DB: db.Conn,
+		Data: &database.Outbox{
+			Chat:        msgs[0].Chat.ID,
+			Channel:     channelID,
+			Payload:     string(payload),
+			Info:        string(info),
+			Status:      database.OutboxPending,
+			Attempts:    1,
+			NextAttempt: time.Now().Add(retryDelay(conf, 1, err)),
+			LastError:   err.Error(),
+		},
+	}
+	if err := om.Create(); err != nil {
+		log.Printf("Cannot create new outbox record in database! See error: %s", err.Error())
+	}
+}
+
+// retry tries to repost outbox entry again
+func retry(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, e *database.Outbox) error {
+	var msgs []*tgbotapi.Message
+	if err := json.Unmarshal([]byte(e.Payload), &msgs); err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	// Entries enqueued before info was stored have none
+	if e.Info != "" {
+		var infos []*tgapi.MessageInfo
+		if err := json.Unmarshal([]byte(e.Info), &infos); err != nil {
+			return err
+		}
+		for i, info := range infos {
+			if i < len(msgs) && info != nil {
+				tgapi.RecordMessageInfo(msgs[i], info)
+			}
+		}
+	}
+
+	reposts, places, err := buildReposts(conf, client, tgbot, msgs)
+	if err != nil || reposts == nil {
+		return err
+	}
+
+	return sendReposts(conf, db, client, tgbot, dcbot, conf.FindDestination(e.Channel), msgs, reposts, places)
+}
+
+// processOutbox retries reposts which time has come.
+// Repost that fails max attempts becomes dead letter, the Telegram chat is notified about it.
+func processOutbox(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session) {
+	om := database.OutboxManager{DB: db.Conn}
+	entries, err := om.FindDue(time.Now())
+	if err != nil {
+		log.Printf("Cannot read outbox records in database! See error: %s", err.Error())
+		return
+	}
+
+	for i := range entries {
+		om.Data = &entries[i]
+
+		err := retry(conf, db, client, tgbot, dcbot, om.Data)
+		if err == nil {
+			log.Printf("Outbox repost %d to channel %s sent after %d attempts", om.Data.ID, om.Data.Channel, om.Data.Attempts+1)
+			if err := om.Delete(); err != nil {
+				log.Printf("Cannot delete outbox record in database! See error: %s", err.Error())
+			}
+			continue
+		}
+
+		om.Data.Attempts++
+		om.Data.LastError = err.Error()
+		if om.Data.Attempts >= conf.Outbox.GetMaxAttempts() {
+			om.Data.Status = database.OutboxDead
+			log.Printf("Repost %d to channel %s failed %d times and will not be retried! Last error: %s", om.Data.ID, om.Data.Channel, om.Data.Attempts, err.Error())
+			l := channelLocale(conf, om.Data.Channel)
+			notifyError(tgbot, om.Data.Chat, l.text("error_dead_letter", om.Data.ID, om.Data.Channel, om.Data.Attempts, err.Error()))
+		} else {
+			om.Data.NextAttempt = time.Now().Add(retryDelay(conf, om.Data.Attempts, err))
+			log.Printf("Outbox repost %d failed, next attempt at %s. See error: %s", om.Data.ID, om.Data.NextAttempt.Format(time.RFC3339), err.Error())
+		}
+		if err := om.Save(); err != nil {
+			log.Printf("Cannot update outbox record in database! See error: %s", err.Error())
+		}
+	}
+}
+
+// RunOutbox retries failed reposts in background
+func RunOutbox(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session) {
+	for range time.Tick(outboxInterval) {
+		processOutbox(conf, db, client, tgbot, dcbot)
+	}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"reposter/config"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tooManyRequests := &discordgo.RESTError{
+		Response:     &http.Response{StatusCode: http.StatusTooManyRequests},
+		ResponseBody: []byte(`{"message": "You are being rate limited.", "retry_after": 90.5}`),
+	}
+	rateLimited := &discordgo.RateLimitError{RateLimit: &discordgo.RateLimit{
+		TooManyRequests: &discordgo.TooManyRequests{RetryAfter: 2 * time.Hour},
+	}}
+	serverError := &discordgo.RESTError{
+		Response:     &http.Response{StatusCode: http.StatusInternalServerError},
+		ResponseBody: []byte(`{"message": "500: Internal Server Error", "retry_after": 90}`),
+	}
+
+	cases := map[string]struct {
+		Outbox   *config.Outbox
+		Attempts int
+		Err      error
+		Expected time.Duration
+	}{
+		"first attempt": {
+			Attempts: 1,
+			Err:      errors.New("lorem"),
+			Expected: 30 * time.Second,
+		},
+		"doubled": {
+			Attempts: 3,
+			Err:      errors.New("lorem"),
+			Expected: 2 * time.Minute,
+		},
+		"max backoff": {
+			Attempts: 20,
+			Err:      errors.New("lorem"),
+			Expected: time.Hour,
+		},
+		"configured": {
+			Outbox:   &config.Outbox{Backoff: "10s", MaxBackoff: "1m"},
+			Attempts: 3,
+			Err:      errors.New("lorem"),
+			Expected: 40 * time.Second,
+		},
+		"configured max": {
+			Outbox:   &config.Outbox{Backoff: "10s", MaxBackoff: "1m"},
+			Attempts: 5,
+			Err:      errors.New("lorem"),
+			Expected: time.Minute,
+		},
+		"too many requests": {
+			Attempts: 1,
+			Err:      tooManyRequests,
+			Expected: 90*time.Second + 500*time.Millisecond,
+		},
+		"too many requests less than backoff": {
+			Attempts: 4,
+			Err:      tooManyRequests,
+			Expected: 4 * time.Minute,
+		},
+		"rate limit over max backoff": {
+			Attempts: 1,
+			Err:      fmt.Errorf("cannot send: %w", rateLimited),
+			Expected: 2 * time.Hour,
+		},
+		"server error": {
+			Attempts: 1,
+			Err:      serverError,
+			Expected: 30 * time.Second,
+		},
+	}
+
+	for name, c := range cases {
+		conf := &config.Config{Outbox: c.Outbox}
+		if delay := retryDelay(conf, c.Attempts, c.Err); delay != c.Expected {
+			t.Errorf("%s: got %s, expected %s", name, delay, c.Expected)
+		}
+	}
+}
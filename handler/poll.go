@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"reposter/config"
+	"reposter/database"
+
+	embed "github.com/Clinet/discordgo-embed"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Discord limits of native polls
+	maxPollAnswers        = 10
+	maxPollQuestionLength = 300
+	maxPollAnswerLength   = 55
+	maxPollDuration       = 768 * time.Hour
+)
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+
+	return string(append(runes[:length-1], '…'))
+}
+
+// newPollRepost builds native Discord poll from the Telegram poll.
+// Returns nil if the poll cannot be native, quizzes have no correct answers in Discord.
+func newPollRepost(conf *config.Config, msg *tgbotapi.Message) *repost {
+	poll := msg.Poll
+	if poll.Type == "quiz" || len(poll.Options) > maxPollAnswers {
+		return nil
+	}
+
+	duration := conf.Discord.GetPollDuration()
+	if poll.OpenPeriod > 0 {
+		duration = time.Duration(poll.OpenPeriod) * time.Second
+	}
+	if duration > maxPollDuration {
+		duration = maxPollDuration
+	}
+
+	p := &discordgo.Poll{
+		Question:         discordgo.PollMedia{Text: truncate(poll.Question, maxPollQuestionLength)},
+		AllowMultiselect: poll.AllowsMultipleAnswers,
+		// Discord counts duration in hours
+		Duration: int((duration + time.Hour - 1) / time.Hour),
+	}
+	for _, o := range poll.Options {
+		p.Answers = append(p.Answers, discordgo.PollAnswer{
+			Media: &discordgo.PollMedia{Text: truncate(o.Text, maxPollAnswerLength)},
+		})
+	}
+
+	return &repost{
+		Content: formatMessage(conf, msg),
+		Poll:    p,
+	}
+}
+
+// updatePoll renders new results of the Telegram poll in all its reposts.
+// Native Discord polls have own votes, they are only ended when the Telegram poll is closed.
+// Bot API sends poll updates only for polls sent by the bot and for stopped polls,
+// so reposts of channel polls get their results once the poll is closed.
+func updatePoll(conf *config.Config, db *database.Database, dcbot *discordgo.Session, poll *tgbotapi.Poll) {
+	pm := database.PostManager{
+		DB: db.Conn,
+		Data: &database.Post{
+			Poll: poll.ID,
+		},
+	}
+	posts, err := pm.FindAllByPoll()
+	if err != nil {
+		log.Printf("Cannot read record in database! See error: %s", err.Error())
+		return
+	}
+
+	for i := range posts {
+		p := &posts[i]
+
+		// Footer and timestamp of the repost are kept, only results are rendered again
+		m, err := dcbot.ChannelMessage(p.MessageChannel(), p.Discord)
+		if err != nil {
+			log.Printf("Cannot read poll repost! See error: %s", err.Error())
+			continue
+		}
+		if m.Poll != nil {
+			finalized := m.Poll.Results != nil && m.Poll.Results.Finalized
+			if poll.IsClosed && !finalized {
+				if _, err := dcbot.PollExpire(p.MessageChannel(), p.Discord); err != nil {
+					log.Printf("Cannot end Discord poll! See error: %s", err.Error())
+				}
+			}
+			continue
+		}
+		if len(m.Embeds) == 0 {
+			continue
+		}
+		e := *m.Embeds[0]
+		// Reply quote goes before the results, which may be rendered in other language before
+		quote := ""
+		for _, l := range catalogs {
+			if i := strings.Index(e.Description, l.text("poll_multiple")); i > 0 {
+				quote = e.Description[:i]
+				break
+			}
+		}
+		formatPoll(channelLocale(conf, p.Channel), &embed.Embed{MessageEmbed: &e}, poll)
+		e.Description = quote + e.Description
+
+		embeds := []*discordgo.MessageEmbed{&e}
+		if _, err := editMessage(db, dcbot, p, &messageEdit{Embeds: &embeds}); err != nil {
+			log.Printf("Cannot update poll results! See error: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"reposter/config"
+	"reposter/tgapi"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"golang.org/x/net/html"
+)
+
+const (
+	// Only the beginning of the page is read for OpenGraph metadata, it is in the head
+	maxPreviewPageSize = 1 << 20
+	previewTimeout     = 10 * time.Second
+	// Telegram shows about the same length of the page description
+	maxPreviewDescription = 300
+)
+
+// previewedLink returns link Telegram shows preview of in the post, empty if the preview is disabled
+func previewedLink(msg *tgbotapi.Message) string {
+	opts := tgapi.GetLinkPreviewOptions(msg)
+	if opts != nil && opts.IsDisabled {
+		return ""
+	}
+	if opts != nil && opts.URL != "" {
+		return opts.URL
+	}
+
+	// Preview of the first link is shown by default
+	for _, e := range msg.Entities {
+		link := e.URL
+		if e.IsURL() {
+			link = tgapi.EntityText(msg.Text, e)
+			if !strings.Contains(link, "://") {
+				link = "https://" + link
+			}
+		}
+		if strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") {
+			return link
+		}
+	}
+
+	return ""
+}
+
+// openGraph fetches the page and returns its OpenGraph properties, the page title and description
+// are returned as "title" and "description"
+func openGraph(client *http.Client, link string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot do GET request! See error: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot download page! Status: %s", resp.Status)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return nil, fmt.Errorf("Link is not a page! Content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	result := make(map[string]string)
+	z := html.NewTokenizer(io.LimitReader(resp.Body, maxPreviewPageSize))
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return result, nil
+		case html.TextToken:
+			if inTitle && result["title"] == "" {
+				result["title"] = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return result, nil
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "body":
+				return result, nil
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = strings.TrimSpace(string(v))
+					}
+				}
+				if (strings.HasPrefix(key, "og:") || key == "description") && content != "" && result[key] == "" {
+					result[key] = content
+				}
+			}
+		}
+	}
+}
+
+// linkPreview returns embed previewing the link Telegram shows preview of in the post, nil if there is none.
+// Link rules of the post route apply to the link, hidden link is not previewed. Color is the one of the repost embed.
+func linkPreview(conf *config.Config, client *http.Client, msg *tgbotapi.Message, color int) *discordgo.MessageEmbed {
+	if !conf.Discord.UseLinkPreviews() || msg.Text == "" {
+		return nil
+	}
+	link := previewedLink(msg)
+	if link == "" {
+		return nil
+	}
+	link = linkRewriter(conf, msg)(link)
+	u, err := url.Parse(link)
+	if err != nil || strings.HasSuffix(link, hiddenLink) {
+		return nil
+	}
+
+	result := &discordgo.MessageEmbed{
+		URL:   link,
+		Title: strings.TrimPrefix(u.Hostname(), "www."),
+		Color: color,
+	}
+	if conf.Discord.LinkPreviews != config.PreviewsOpenGraph {
+		return result
+	}
+
+	og, err := openGraph(client, link)
+	if err != nil {
+		log.Printf("Cannot fetch link preview of %s! See error: %s", link, err.Error())
+		return result
+	}
+	if title := og["og:title"]; title != "" {
+		result.Title = title
+	} else if og["title"] != "" {
+		result.Title = og["title"]
+	}
+	result.Title = truncate(result.Title, 256)
+	description := og["og:description"]
+	if description == "" {
+		description = og["description"]
+	}
+	result.Description = tgapi.EntitiesToDiscordMarkdown(truncate(description, maxPreviewDescription), nil)
+	if site := og["og:site_name"]; site != "" {
+		result.Author = &discordgo.MessageEmbedAuthor{Name: truncate(site, 256)}
+	}
+	if image, err := u.Parse(og["og:image"]); err == nil && og["og:image"] != "" {
+		// Telegram shows small image if the post asks for it
+		if opts := tgapi.GetLinkPreviewOptions(msg); opts != nil && opts.PreferSmallMedia {
+			result.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: image.String()}
+		} else {
+			result.Image = &discordgo.MessageEmbedImage{URL: image.String()}
+		}
+	}
+
+	return result
+}
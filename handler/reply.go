@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"reposter/database"
+	"reposter/tgapi"
+
+	embed "github.com/Clinet/discordgo-embed"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Max length of replied post text quoted in repost
+const replyQuoteLength = 100
+
+// telegramPostLink returns link to the post in public or private Telegram channel
+func telegramPostLink(msg *tgbotapi.Message) string {
+	if msg.Chat.UserName != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", msg.Chat.UserName, msg.MessageID)
+	}
+
+	// Private channel links use chat ID without -100 prefix
+	id := strings.TrimPrefix(strconv.FormatInt(msg.Chat.ID, 10), "-100")
+	return fmt.Sprintf("https://t.me/c/%s/%d", id, msg.MessageID)
+}
+
+// discordMessageLink returns jump link to the message in Discord channel
+func discordMessageLink(dcbot *discordgo.Session, channelID, messageID string) string {
+	guildID := "@me"
+	if ch, err := getChannel(dcbot, channelID); err == nil && ch.GuildID != "" {
+		guildID = ch.GuildID
+	}
+
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, channelID, messageID)
+}
+
+// findRepost returns repost of the Telegram post in the channel holding its text, nil if the post was not reposted.
+func findRepost(db *database.Database, channelID string, msg *tgbotapi.Message) *database.Post {
+	pm := database.PostManager{
+		DB: db.Conn,
+		Data: &database.Post{
+			Telegram: telegramPostID(msg),
+		},
+	}
+	posts, err := pm.FindAllByTelegramPost()
+	if err != nil {
+		log.Printf("Cannot read record in database! See error: %s", err.Error())
+		return nil
+	}
+
+	for i := range posts {
+		if posts[i].Channel == channelID && posts[i].Part == 0 {
+			return &posts[i]
+		}
+	}
+
+	return nil
+}
+
+// replyQuote quotes beginning of the replied post text followed by the link to it
+func replyQuote(replied *tgbotapi.Message, link string) string {
+	text := []rune(strings.Join(strings.Fields(replied.Text+replied.Caption), " "))
+	if len(text) > replyQuoteLength {
+		text = append(text[:replyQuoteLength], '…')
+	}
+
+	quote := ""
+	if len(text) > 0 {
+		quote = "> " + tgapi.EntitiesToDiscordMarkdown(string(text), nil) + "\n"
+	}
+
+	return quote + "↪ " + link + "\n\n"
+}
+
+// withReply returns copy of the repost replying to repost of the post msg replies to.
+// Messages sent by the bot become Discord replies. Webhooks cannot reply and forum posts cannot reply
+// to other threads, so they quote replied post with jump link to it. Quote with link to Telegram
+// is used as well when replied post was not reposted.
+func (r *repost) withReply(db *database.Database, dcbot *discordgo.Session, channelID string, msg *tgbotapi.Message, quoted bool) *repost {
+	result := *r
+
+	quote := ""
+	if p := findRepost(db, channelID, msg.ReplyToMessage); p == nil {
+		quote = replyQuote(msg.ReplyToMessage, telegramPostLink(msg.ReplyToMessage))
+	} else if quoted {
+		quote = replyQuote(msg.ReplyToMessage, discordMessageLink(dcbot, p.MessageChannel(), p.Discord))
+	} else {
+		failIfNotExists := false
+		result.Reference = &discordgo.MessageReference{
+			MessageID:       p.Discord,
+			ChannelID:       channelID,
+			FailIfNotExists: &failIfNotExists,
+		}
+	}
+
+	if quote != "" {
+		if result.Embed != nil {
+			e := *result.Embed.MessageEmbed
+			e.Description = quote + e.Description
+			result.Embed = &embed.Embed{MessageEmbed: &e}
+		} else {
+			result.Content = quote + result.Content
+		}
+	}
+
+	return &result
+}
@@ -0,0 +1,378 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"reposter/config"
+	"reposter/database"
+	"reposter/tgapi"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// Telegram limit of media caption length
+	maxCaption = 1024
+	// Bot API limit of uploaded file size
+	maxUploadSize = 50 << 20
+	// Telegram limit of files in media group
+	maxMediaGroup = 10
+)
+
+// Custom Discord emoji <:name:id> cannot be shown in Telegram, its name is shown instead
+var customEmojiRe = regexp.MustCompile(`<a?(:\w+:)\d+>`)
+
+// telegramFile is Discord attachment downloaded to upload to Telegram
+type telegramFile struct {
+	tgbotapi.FileBytes
+	// Discord attachment ID
+	ID   string
+	Kind string
+}
+
+// fileKind returns which kind of Telegram media the file is sent as
+func fileKind(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/") && contentType != "image/gif":
+		return "photo"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video"
+	case strings.HasPrefix(contentType, "audio/"):
+		return "audio"
+	}
+
+	return "document"
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// messageAuthor returns name of the Discord message author shown on the server
+func messageAuthor(m *discordgo.Message) string {
+	if m.Member != nil && m.Member.Nick != "" {
+		return m.Member.Nick
+	}
+	if m.Author.GlobalName != "" {
+		return m.Author.GlobalName
+	}
+
+	return m.Author.Username
+}
+
+// reverseText converts text of the Discord message to Telegram text with entities, signed with the author name
+func reverseText(dcbot *discordgo.Session, m *discordgo.Message) (string, []tgbotapi.MessageEntity) {
+	content, err := m.ContentWithMoreMentionsReplaced(dcbot)
+	if err != nil {
+		content = m.ContentWithMentionsReplaced()
+	}
+	content = customEmojiRe.ReplaceAllString(content, "$1")
+
+	text, entities := tgapi.DiscordMarkdownToEntities(content)
+
+	author := messageAuthor(m)
+	shift := utf16Len(author + "\n")
+	for i := range entities {
+		entities[i].Offset += shift
+	}
+	entities = append([]tgbotapi.MessageEntity{{Type: "bold", Offset: 0, Length: utf16Len(author)}}, entities...)
+
+	return author + "\n" + text, entities
+}
+
+// isEcho reports that the Discord message was sent by the bot itself, so it must not be posted back to Telegram
+func isEcho(db *database.Database, dcbot *discordgo.Session, m *discordgo.Message) bool {
+	if m.Author == nil || (dcbot.State.User != nil && m.Author.ID == dcbot.State.User.ID) {
+		return true
+	}
+
+	if m.WebhookID != "" {
+		wm := database.WebhookManager{
+			DB: db.Conn,
+			Data: &database.Webhook{
+				WebhookID: m.WebhookID,
+			},
+		}
+		if wm.FindByWebhookID() == nil {
+			return true
+		}
+	}
+
+	pm := database.PostManager{
+		DB: db.Conn,
+		Data: &database.Post{
+			Discord: m.ID,
+		},
+	}
+	mirror, err := pm.IsMirror()
+	if err != nil {
+		log.Printf("Cannot read record in database! See error: %s", err.Error())
+	}
+
+	return mirror
+}
+
+// isReverseMirror reports that the Telegram post was posted by the bot from Discord
+func isReverseMirror(db *database.Database, msg *tgbotapi.Message) bool {
+	pm := database.PostManager{
+		DB: db.Conn,
+		Data: &database.Post{
+			Telegram: telegramPostID(msg),
+		},
+	}
+	mirror, err := pm.IsMirror()
+	if err != nil {
+		log.Printf("Cannot read record in database! See error: %s", err.Error())
+	}
+
+	return mirror
+}
+
+// telegramChat returns base of message to the Telegram chat, chat is either ID or @username
+func telegramChat(ref string) (tgbotapi.BaseChat, error) {
+	chatID, userName, err := config.ParseChat(ref)
+	if err != nil {
+		return tgbotapi.BaseChat{}, fmt.Errorf("Wrong Telegram chat %s! See error: %s", ref, err.Error())
+	}
+	if userName != "" {
+		return tgbotapi.BaseChat{ChannelUsername: "@" + userName}, nil
+	}
+
+	return tgbotapi.BaseChat{ChatID: chatID}, nil
+}
+
+// sendTelegramFile sends single file with caption
+func sendTelegramFile(tgbot *tgbotapi.BotAPI, chat tgbotapi.BaseChat, f *telegramFile, caption string, entities []tgbotapi.MessageEntity) (tgbotapi.Message, error) {
+	base := tgbotapi.BaseFile{BaseChat: chat, File: f.FileBytes}
+
+	var c tgbotapi.Chattable
+	switch f.Kind {
+	case "photo":
+		c = tgbotapi.PhotoConfig{BaseFile: base, Caption: caption, CaptionEntities: entities}
+	case "video":
+		c = tgbotapi.VideoConfig{BaseFile: base, Caption: caption, CaptionEntities: entities}
+	case "audio":
+		c = tgbotapi.AudioConfig{BaseFile: base, Caption: caption, CaptionEntities: entities}
+	default:
+		c = tgbotapi.DocumentConfig{BaseFile: base, Caption: caption, CaptionEntities: entities}
+	}
+
+	return tgbot.Send(c)
+}
+
+// sendTelegramAlbum sends files as media groups, caption is added to the first file.
+// Photos and videos may be grouped together, audios only with audios, anything else is sent as documents.
+func sendTelegramAlbum(tgbot *tgbotapi.BotAPI, chat tgbotapi.BaseChat, files []*telegramFile, caption string, entities []tgbotapi.MessageEntity) ([]tgbotapi.Message, error) {
+	visual, audio := true, true
+	for _, f := range files {
+		visual = visual && (f.Kind == "photo" || f.Kind == "video")
+		audio = audio && f.Kind == "audio"
+	}
+
+	var result []tgbotapi.Message
+	for start := 0; start < len(files); start += maxMediaGroup {
+		end := start + maxMediaGroup
+		if end > len(files) {
+			end = len(files)
+		}
+
+		var group []interface{}
+		for i, f := range files[start:end] {
+			base := tgbotapi.BaseInputMedia{Media: f.FileBytes}
+			if start == 0 && i == 0 {
+				base.Caption, base.CaptionEntities = caption, entities
+			}
+			switch {
+			case visual && f.Kind == "photo":
+				base.Type = "photo"
+				group = append(group, tgbotapi.InputMediaPhoto{BaseInputMedia: base})
+			case visual:
+				base.Type = "video"
+				group = append(group, tgbotapi.InputMediaVideo{BaseInputMedia: base})
+			case audio:
+				base.Type = "audio"
+				group = append(group, tgbotapi.InputMediaAudio{BaseInputMedia: base})
+			default:
+				base.Type = "document"
+				group = append(group, tgbotapi.InputMediaDocument{BaseInputMedia: base})
+			}
+		}
+
+		msgs, err := tgbot.SendMediaGroup(tgbotapi.MediaGroupConfig{
+			ChatID:          chat.ChatID,
+			ChannelUsername: chat.ChannelUsername,
+			Media:           group,
+		})
+		if err != nil {
+			return result, err
+		}
+		result = append(result, msgs...)
+	}
+
+	return result, nil
+}
+
+// reverseMessage posts the Discord message to Telegram chats of reverse routes and links them in database.
+// The first Telegram message holds the text, so it can be edited later.
+func reverseMessage(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, m *discordgo.Message) {
+	chats := conf.ReverseChats(m.ChannelID)
+	if len(chats) == 0 || isEcho(db, dcbot, m) {
+		return
+	}
+
+	text, entities := reverseText(dcbot, m)
+
+	var files []*telegramFile
+	for _, a := range m.Attachments {
+		// Too large files are linked instead
+		if a.Size > maxUploadSize {
+			text += "\n" + a.URL
+			continue
+		}
+		data, err := fetch(client, a.URL)
+		if err != nil {
+			log.Printf("Cannot download attachment %s! See error: %s", a.Filename, err.Error())
+			text += "\n" + a.URL
+			continue
+		}
+		files = append(files, &telegramFile{
+			FileBytes: tgbotapi.FileBytes{Name: a.Filename, Bytes: data},
+			ID:        a.ID,
+			Kind:      fileKind(a.ContentType),
+		})
+	}
+
+	for _, ref := range chats {
+		chat, err := telegramChat(ref)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		// Text too long for caption is sent before files.
+		// Every sent message is kept with ID of the attachment it holds.
+		var sent []tgbotapi.Message
+		var attachments []string
+		caption, captionEntities := text, entities
+		if len(files) == 0 || utf16Len(text) > maxCaption {
+			msg := tgbotapi.MessageConfig{BaseChat: chat, Text: text, Entities: entities}
+			tm, err := tgbot.Send(msg)
+			if err != nil {
+				log.Printf("Cannot post Discord message %s to Telegram chat %s! See error: %s", m.ID, ref, err.Error())
+				continue
+			}
+			sent = append(sent, tm)
+			attachments = append(attachments, "")
+			caption, captionEntities = "", nil
+		}
+
+		if len(files) == 1 {
+			tm, err := sendTelegramFile(tgbot, chat, files[0], caption, captionEntities)
+			if err != nil {
+				log.Printf("Cannot post attachments of Discord message %s to Telegram chat %s! See error: %s", m.ID, ref, err.Error())
+			} else {
+				sent = append(sent, tm)
+				attachments = append(attachments, files[0].ID)
+			}
+		} else if len(files) > 1 {
+			tms, err := sendTelegramAlbum(tgbot, chat, files, caption, captionEntities)
+			if err != nil {
+				log.Printf("Cannot post attachments of Discord message %s to Telegram chat %s! See error: %s", m.ID, ref, err.Error())
+			}
+			for i := range tms {
+				sent = append(sent, tms[i])
+				attachments = append(attachments, files[i].ID)
+			}
+		}
+
+		for i := range sent {
+			p := &database.Post{
+				Telegram:   telegramPostID(&sent[i]),
+				Channel:    m.ChannelID,
+				Discord:    m.ID,
+				Part:       i,
+				Attachment: attachments[i],
+				Direction:  database.DirectionToTelegram,
+			}
+			pm := database.PostManager{DB: db.Conn, Data: p}
+			if err := pm.Create(); err != nil {
+				log.Printf("Cannot create new record in database! TG: %s. See error: %s", p.Telegram, err.Error())
+			}
+		}
+	}
+}
+
+// reverseEdit updates text of Telegram posts the edited Discord message was posted as
+func reverseEdit(conf *config.Config, db *database.Database, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, m *discordgo.Message) {
+	// Updates without author are embeds resolved by Discord, not edits
+	if len(conf.ReverseChats(m.ChannelID)) == 0 || m.Author == nil || m.EditedTimestamp == nil {
+		return
+	}
+
+	pm := database.PostManager{
+		DB: db.Conn,
+		Data: &database.Post{
+			Discord: m.ID,
+		},
+	}
+	posts, err := pm.FindAllByDiscordMessage()
+	if err != nil {
+		log.Printf("Cannot read record in database! See error: %s", err.Error())
+		return
+	}
+
+	text, entities := reverseText(dcbot, m)
+	for _, p := range posts {
+		if p.Part != 0 {
+			continue
+		}
+
+		var chatID int64
+		var messageID int
+		if _, err := fmt.Sscanf(p.Telegram, "%d,%d", &chatID, &messageID); err != nil {
+			log.Printf("Wrong Telegram post ID %s! See error: %s", p.Telegram, err.Error())
+			continue
+		}
+
+		var edit tgbotapi.Chattable
+		if p.Attachment == "" {
+			edit = tgbotapi.EditMessageTextConfig{
+				BaseEdit: tgbotapi.BaseEdit{ChatID: chatID, MessageID: messageID},
+				Text:     text,
+				Entities: entities,
+			}
+		} else if utf16Len(text) <= maxCaption {
+			edit = tgbotapi.EditMessageCaptionConfig{
+				BaseEdit:        tgbotapi.BaseEdit{ChatID: chatID, MessageID: messageID},
+				Caption:         text,
+				CaptionEntities: entities,
+			}
+		} else {
+			log.Printf("Cannot edit Telegram post %s, text is too long for caption", p.Telegram)
+			continue
+		}
+		if _, err := tgbot.Request(edit); err != nil {
+			log.Printf("Cannot edit Telegram post %s! See error: %s", p.Telegram, err.Error())
+		}
+	}
+}
+
+// RunReverse starts posting messages of Discord channels to Telegram chats, if reverse routes are configured
+func RunReverse(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session) {
+	if len(conf.Reverse) == 0 {
+		return
+	}
+
+	dcbot.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		reverseMessage(conf, db, client, tgbot, s, m.Message)
+	})
+	dcbot.AddHandler(func(s *discordgo.Session, m *discordgo.MessageUpdate) {
+		reverseEdit(conf, db, tgbot, s, m.Message)
+	})
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"reposter/database"
+	"reposter/tgapi"
+
+	embed "github.com/Clinet/discordgo-embed"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord limits of message texts
+// https://discord.com/developers/docs/resources/channel#embed-limits
+const (
+	maxContentLength     = 2000
+	maxDescriptionLength = 4096
+	// Total length of texts of all embeds of the message
+	maxEmbedsLength = 6000
+	// Number of embeds in the message
+	maxEmbeds = 10
+)
+
+// embedLength returns length of the embed texts counted against maxEmbedsLength
+func embedLength(e *discordgo.MessageEmbed) int {
+	n := tgapi.MarkdownLength(e.Title) + tgapi.MarkdownLength(e.Description)
+	if e.Author != nil {
+		n += tgapi.MarkdownLength(e.Author.Name)
+	}
+	if e.Footer != nil {
+		n += tgapi.MarkdownLength(e.Footer.Text)
+	}
+	for _, f := range e.Fields {
+		n += tgapi.MarkdownLength(f.Name) + tgapi.MarkdownLength(f.Value)
+	}
+
+	return n
+}
+
+// split returns the repost split into messages fitting Discord limits. The first message keeps files, reply
+// and the beginning of the text, the rest continue the text.
+func (r *repost) split() []*repost {
+	first := *r
+	result := []*repost{&first}
+
+	contents := tgapi.SplitMarkdown(r.Content, maxContentLength)
+	first.Content = contents[0]
+	for _, c := range contents[1:] {
+		result = append(result, &repost{Content: c, Username: r.Username})
+	}
+
+	if r.Embed == nil {
+		return result
+	}
+
+	limit := maxEmbedsLength
+	for _, e := range r.embeds() {
+		limit -= embedLength(e)
+	}
+	limit += tgapi.MarkdownLength(r.Embed.Description)
+	if limit > maxDescriptionLength {
+		limit = maxDescriptionLength
+	}
+
+	descriptions := tgapi.SplitMarkdown(r.Embed.Description, limit)
+	if len(descriptions) == 1 {
+		return result
+	}
+	e := *r.Embed.MessageEmbed
+	e.Description = descriptions[0]
+	first.Embed = &embed.Embed{MessageEmbed: &e}
+	for _, d := range descriptions[1:] {
+		next := embed.NewEmbed().SetColor(e.Color)
+		next.Description = d
+		result = append(result, &repost{Embed: next, Username: r.Username})
+	}
+
+	return result
+}
+
+// isTextPart reports that the repost message holds the text or its part
+func isTextPart(p *database.Post) bool {
+	return p.Part == 0 || p.Chunk > 0
+}
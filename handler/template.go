@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"reposter/config"
+	"reposter/tgapi"
+
+	embed "github.com/Clinet/discordgo-embed"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// templateData is what templates of reposts are executed with
+type templateData struct {
+	// Telegram post as Bot API sends it
+	Message *tgbotapi.Message
+	// Text and caption of the post in Discord markdown
+	Text string
+	// Author signature and forward attribution of the post, empty if there are none
+	Signature     string
+	ForwardedFrom string
+	// Link to the post in Telegram, and to the original post if it is forwarded from public channel
+	Link        string
+	ForwardLink string
+}
+
+func newTemplateData(conf *config.Config, msg *tgbotapi.Message, text string) *templateData {
+	return &templateData{
+		Message:       msg,
+		Text:          text,
+		Signature:     strings.TrimSpace(getAuthorSignature(msg)),
+		ForwardedFrom: getForwardedFrom(chatLocale(conf, msg.Chat), msg),
+		Link:          telegramPostLink(msg),
+		ForwardLink:   getPostLink(msg),
+	}
+}
+
+// Functions available in templates besides the builtin ones
+var templateFuncs = template.FuncMap{
+	"truncate": truncate,
+	// Plain text shown as is in Discord markdown
+	"escape": func(s string) string {
+		return tgapi.EntitiesToDiscordMarkdown(s, nil)
+	},
+}
+
+var (
+	parsedTemplates   = make(map[string]*template.Template)
+	parsedTemplatesMu sync.Mutex
+)
+
+// parseTemplate parses the template once and returns it from cache after that
+func parseTemplate(text string) (*template.Template, error) {
+	parsedTemplatesMu.Lock()
+	defer parsedTemplatesMu.Unlock()
+
+	if t, ok := parsedTemplates[text]; ok {
+		return t, nil
+	}
+	t, err := template.New("").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	parsedTemplates[text] = t
+
+	return t, nil
+}
+
+// CheckTemplates parses templates of all routes, so mistakes in them are found at start
+func CheckTemplates(conf *config.Config) error {
+	for _, r := range conf.Routes {
+		if r.Template == nil {
+			continue
+		}
+		for _, text := range r.Template.All() {
+			if _, err := parseTemplate(text); err != nil {
+				return fmt.Errorf("route %s: %w", r.Telegram, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// executeTemplate renders the template. Returns false if the template is empty or cannot be executed, so default is used.
+func executeTemplate(text string, data *templateData) (string, bool) {
+	if text == "" {
+		return "", false
+	}
+
+	t, err := parseTemplate(text)
+	if err != nil {
+		log.Printf("Cannot parse template! See error: %s", err.Error())
+		return "", false
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		log.Printf("Cannot execute template! See error: %s", err.Error())
+		return "", false
+	}
+
+	return strings.TrimSpace(b.String()), true
+}
+
+// routeTemplate returns templates of the route the post came from, nil if the route has none
+func routeTemplate(conf *config.Config, msg *tgbotapi.Message) *config.Template {
+	if r := conf.FindRoute(msg.Chat.ID, msg.Chat.UserName); r != nil {
+		return r.Template
+	}
+
+	return nil
+}
+
+// parseColor parses color as "#30a3e6", "0x30a3e6" or decimal number
+func parseColor(s string) (int, error) {
+	if strings.HasPrefix(s, "#") || strings.HasPrefix(s, "0x") {
+		n, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimPrefix(s, "#"), "0x"), 16, 32)
+		return int(n), err
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+
+	return int(n), err
+}
+
+// applyTemplate replaces parts of the embed with rendered templates, parts with empty template are left as is
+func applyTemplate(t *config.Template, e *embed.Embed, data *templateData) {
+	if s, ok := executeTemplate(t.Title, data); ok {
+		e.Title = s
+	}
+	if s, ok := executeTemplate(t.Description, data); ok {
+		e.Description = s
+	}
+	if s, ok := executeTemplate(t.Footer, data); ok {
+		e.Footer = nil
+		if s != "" {
+			e.Footer = &discordgo.MessageEmbedFooter{Text: s}
+		}
+	}
+	if s, ok := executeTemplate(t.Author, data); ok {
+		e.Author = nil
+		if s != "" {
+			e.Author = &discordgo.MessageEmbedAuthor{Name: s}
+		}
+	}
+	if s, ok := executeTemplate(t.Color, data); ok {
+		if color, err := parseColor(s); err != nil {
+			log.Printf("Cannot parse embed color %q! See error: %s", s, err.Error())
+		} else {
+			e.Color = color
+		}
+	}
+
+	if len(t.Fields) == 0 {
+		return
+	}
+	e.Fields = nil
+	for _, f := range t.Fields {
+		name, _ := executeTemplate(f.Name, data)
+		value, _ := executeTemplate(f.Value, data)
+		if name != "" && value != "" {
+			e.Fields = append(e.Fields, &discordgo.MessageEmbedField{Name: name, Value: value, Inline: f.Inline})
+		}
+	}
+}
+
+// sampleMessage returns post to preview templates of the chat with
+func sampleMessage(chat string) *tgbotapi.Message {
+	chatID, userName, _ := config.ParseChat(chat)
+
+	return &tgbotapi.Message{
+		MessageID: 42,
+		Chat: &tgbotapi.Chat{
+			ID:       chatID,
+			Type:     "channel",
+			Title:    "Sample channel",
+			UserName: userName,
+		},
+		Date:            int(time.Now().Unix()),
+		AuthorSignature: "Author",
+		Text:            "Lorem ipsum dolor sit amet, consectetur adipiscing elit.",
+		Entities: []tgbotapi.MessageEntity{
+			{Type: "bold", Offset: 0, Length: 11},
+		},
+	}
+}
+
+// PreviewTemplate renders the sample post (Telegram message JSON) as the route of the chat (ID or @username) does.
+// Built-in sample post is used if sample is empty. Returns Discord messages as JSON.
+func PreviewTemplate(conf *config.Config, chat string, sample []byte) (string, error) {
+	msg := sampleMessage(chat)
+	if len(sample) > 0 {
+		msg = &tgbotapi.Message{}
+		if err := json.Unmarshal(sample, msg); err != nil {
+			return "", fmt.Errorf("Cannot parse sample message! See error: %s", err.Error())
+		}
+		// Route is found by the chat, so the sample is posted to it
+		c := sampleMessage(chat).Chat
+		if msg.Chat != nil && msg.Chat.Title != "" {
+			c.Title = msg.Chat.Title
+		}
+		msg.Chat = c
+	}
+
+	r, _ := renderRepost(conf, msg)
+	if r == nil {
+		return "", fmt.Errorf("Sample message type is not supported")
+	}
+
+	var messages []*discordgo.MessageSend
+	for _, part := range r.split() {
+		messages = append(messages, part.MessageSend())
+	}
+
+	return PrettyPrint(messages), nil
+}
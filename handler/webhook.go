@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"reposter/config"
+	"reposter/database"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jinzhu/gorm"
+)
+
+// How long Telegram chat photo is cached before asking getChat again
+const chatPhotoTTL = 10 * time.Minute
+
+type chatPhoto struct {
+	// Unique file ID of the photo, empty if chat has no photo
+	ID string
+	// Photo as data URI accepted by Discord as webhook avatar
+	Avatar  string
+	Expires time.Time
+}
+
+var (
+	chatPhotos   = make(map[int64]*chatPhoto)
+	chatPhotosMu sync.Mutex
+)
+
+// getChatPhoto returns Telegram chat photo, downloading it only when it was changed.
+func getChatPhoto(conf *config.Config, client *http.Client, tgbot *tgbotapi.BotAPI, chatID int64) (*chatPhoto, error) {
+	chatPhotosMu.Lock()
+	cached := chatPhotos[chatID]
+	chatPhotosMu.Unlock()
+	if cached != nil && time.Now().Before(cached.Expires) {
+		return cached, nil
+	}
+
+	chat, err := tgbot.GetChat(tgbotapi.ChatInfoConfig{ChatConfig: tgbotapi.ChatConfig{ChatID: chatID}})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get chat info! See error: %s", err.Error())
+	}
+
+	photo := &chatPhoto{}
+	if chat.Photo != nil {
+		photo.ID = chat.Photo.BigFileUniqueID
+		if cached != nil && cached.ID == photo.ID {
+			photo.Avatar = cached.Avatar
+		} else {
+			data, err := downloadFile(conf, client, tgbot, chat.Photo.BigFileID)
+			if err != nil {
+				return nil, err
+			}
+			photo.Avatar = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data)
+		}
+	}
+	photo.Expires = time.Now().Add(chatPhotoTTL)
+
+	chatPhotosMu.Lock()
+	chatPhotos[chatID] = photo
+	chatPhotosMu.Unlock()
+
+	return photo, nil
+}
+
+// webhookName fits Telegram chat title into Discord limits for webhook names (1-80 characters)
+func webhookName(title string) string {
+	name := []rune(title)
+	if len(name) == 0 {
+		return "Telegram"
+	}
+	if len(name) > 80 {
+		name = name[:80]
+	}
+
+	return string(name)
+}
+
+// getWebhook returns webhook for reposts from the Telegram chat into the Discord channel.
+// Webhook is created on first use and its avatar is kept in sync with the chat photo.
+// Avatar is only cosmetic, so webhook is used without it if the chat photo cannot be got.
+func getWebhook(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, channelID string, chat *tgbotapi.Chat) (*database.Webhook, error) {
+	photo, err := getChatPhoto(conf, client, tgbot, chat.ID)
+	if err != nil {
+		log.Printf("Cannot get photo of chat %d for webhook avatar! See error: %s", chat.ID, err.Error())
+		photo = nil
+	}
+
+	wm := database.WebhookManager{
+		DB: db.Conn,
+		Data: &database.Webhook{
+			Channel: channelID,
+			Chat:    chat.ID,
+		},
+	}
+	err = wm.FindByChannelChat()
+	if gorm.IsRecordNotFoundError(err) {
+		avatar := ""
+		if photo != nil {
+			avatar = photo.Avatar
+			wm.Data.Photo = photo.ID
+		}
+		wh, err := dcbot.WebhookCreate(channelID, webhookName(chat.Title), avatar)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create webhook in channel %s! See error: %s", channelID, err.Error())
+		}
+		wm.Data.WebhookID = wh.ID
+		wm.Data.Token = wh.Token
+		if err := wm.Create(); err != nil {
+			return nil, fmt.Errorf("Cannot create new webhook record in database! See error: %s", err.Error())
+		}
+
+		return wm.Data, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Cannot read webhook record in database! See error: %s", err.Error())
+	}
+
+	if photo != nil && wm.Data.Photo != photo.ID {
+		_, err := dcbot.WebhookEditWithToken(wm.Data.WebhookID, wm.Data.Token, webhookName(chat.Title), photo.Avatar)
+		if err != nil {
+			log.Printf("Cannot update webhook avatar! See error: %s", err.Error())
+		} else {
+			wm.Data.Photo = photo.ID
+			if err := wm.Save(); err != nil {
+				log.Printf("Cannot update webhook record in database! See error: %s", err.Error())
+			}
+		}
+	}
+
+	return wm.Data, nil
+}
+
+func isUnknownWebhook(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	return ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownWebhook
+}
+
+// sendWebhook posts repost with webhook on behalf of the Telegram chat.
+// Repost goes to the thread of the channel if threadID is set, or starts new forum post if threadName is set.
+// Webhook deleted in Discord is forgotten and created again.
+func sendWebhook(conf *config.Config, db *database.Database, client *http.Client, tgbot *tgbotapi.BotAPI, dcbot *discordgo.Session, channelID, threadID, threadName string, chat *tgbotapi.Chat, r *repost) (*discordgo.Message, *database.Webhook, error) {
+	for attempt := 0; ; attempt++ {
+		wh, err := getWebhook(conf, db, client, tgbot, dcbot, channelID, chat)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		username := webhookName(chat.Title)
+		if r.Username != "" {
+			username = webhookName(r.Username)
+		}
+
+		ms := r.MessageSend()
+		params := &discordgo.WebhookParams{
+			Content:         ms.Content,
+			Username:        username,
+			Files:           ms.Files,
+			Embeds:          ms.Embeds,
+			ThreadName:      threadName,
+			AllowedMentions: ms.AllowedMentions,
+		}
+
+		var m *discordgo.Message
+		if threadID != "" {
+			m, err = dcbot.WebhookThreadExecute(wh.WebhookID, wh.Token, true, threadID, params)
+		} else {
+			m, err = dcbot.WebhookExecute(wh.WebhookID, wh.Token, true, params)
+		}
+		if err != nil && isUnknownWebhook(err) && attempt == 0 {
+			log.Printf("Webhook %s was deleted in Discord, creating new one", wh.WebhookID)
+			wm := database.WebhookManager{DB: db.Conn, Data: wh}
+			if err := wm.Delete(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		return m, wh, err
+	}
+}
+
+// editWebhookMessage edits repost sent with webhook.
+func editWebhookMessage(db *database.Database, dcbot *discordgo.Session, p *database.Post, edit *discordgo.WebhookEdit) (*discordgo.Message, error) {
+	wm := database.WebhookManager{
+		DB: db.Conn,
+		Data: &database.Webhook{
+			WebhookID: p.Webhook,
+		},
+	}
+	if err := wm.FindByWebhookID(); err != nil {
+		return nil, fmt.Errorf("Cannot read webhook record in database! See error: %s", err.Error())
+	}
+
+	return dcbot.WebhookMessageEdit(wm.Data.WebhookID, wm.Data.Token, p.Discord, edit, withThread(p.Thread))
+}
@@ -1,9 +1,12 @@
 package main // import "reposter"
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,6 +16,7 @@ import (
 	"reposter/handler"
 	"reposter/proxy"
 	"reposter/tgapi"
+	"strconv"
 )
 
 var (
@@ -21,8 +25,97 @@ var (
 		"",
 		"enter path to config file",
 	)
+	deadLetters = flag.Bool(
+		"dead-letters",
+		false,
+		"list reposts that failed too many times and exit",
+	)
+	requeue = flag.String(
+		"requeue",
+		"",
+		"requeue dead letter by ID (or \"all\") and exit",
+	)
+	preview = flag.String(
+		"preview",
+		"",
+		"print reposts of sample post from Telegram chat (ID or @username) as its route templates render them and exit",
+	)
+	sample = flag.String(
+		"sample",
+		"",
+		"path to JSON of Telegram message used as sample post by -preview",
+	)
 )
 
+// runPreviewCommand prints sample post rendered with templates, returns false if no such command given
+func runPreviewCommand(conf *config.Config) bool {
+	if *preview == "" {
+		return false
+	}
+
+	var data []byte
+	if *sample != "" {
+		var err error
+		data, err = ioutil.ReadFile(*sample)
+		if err != nil {
+			fmt.Println("Cannot read sample post! See, error:")
+			panic(err)
+		}
+	}
+
+	out, err := handler.PreviewTemplate(conf, *preview, data)
+	if err != nil {
+		fmt.Println("Cannot render sample post! See, error:")
+		panic(err)
+	}
+	fmt.Println(out)
+
+	return true
+}
+
+// runOutboxCommand lists or requeues dead letters, returns false if no such command given
+func runOutboxCommand(db *database.Database) bool {
+	if !*deadLetters && *requeue == "" {
+		return false
+	}
+
+	om := database.OutboxManager{DB: db.Conn}
+	entries, err := om.FindDead()
+	if err != nil {
+		fmt.Println("Cannot read dead letters! See, error:")
+		panic(err)
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		if *deadLetters {
+			fmt.Printf("%d\tchat %d\tchannel %s\t%d attempts\t%s\n", e.ID, e.Chat, e.Channel, e.Attempts, e.LastError)
+			continue
+		}
+		if *requeue != "all" && *requeue != strconv.FormatUint(uint64(e.ID), 10) {
+			continue
+		}
+
+		om.Data = e
+		if err := om.Requeue(); err != nil {
+			fmt.Println("Cannot requeue dead letter! See, error:")
+			panic(err)
+		}
+		fmt.Printf("Dead letter %d requeued\n", e.ID)
+	}
+
+	return true
+}
+
+// serveMetrics serves expvar metrics, e.g. updates rejected from not allowed chats, at /debug/vars
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Cannot serve metrics on %s! See error: %s", addr, err.Error())
+	}
+}
+
 func main() {
 	// Parse at first startup
 	flag.Parse()
@@ -30,16 +123,47 @@ func main() {
 	// Read config
 	conf, err := config.NewConfig(*path)
 	if err != nil {
-		fmt.Println("Incorrect path or config itself! See help.")
+		fmt.Printf("Incorrect path or config itself! See help. Error: %s\n", err.Error())
 		os.Exit(2)
 	}
 
+	if err := handler.CheckTemplates(conf); err != nil {
+		fmt.Println("Incorrect template in config! See, error:")
+		panic(err)
+	}
+	if err := handler.CheckLanguages(conf); err != nil {
+		fmt.Println("Incorrect language in config! See, error:")
+		panic(err)
+	}
+	if runPreviewCommand(conf) {
+		return
+	}
+
+	// Init database
+	db, err := database.NewDatabase(conf)
+	if err != nil {
+		fmt.Println("Database cannot be initialized! See, error:")
+		panic(err)
+	}
+
+	// Try auto migration for first start
+	err = db.AutoMigrate()
+	if err != nil {
+		fmt.Println("Cannot auto migrate! See, error:")
+		panic(err)
+	}
+
+	if runOutboxCommand(db) {
+		return
+	}
+
 	// Init discord api
 	dcbot, err := dcapi.NewSession(conf)
 	if err != nil {
 		fmt.Println("Discord bot cannot be initialized! See, error:")
 		panic(err)
 	}
+	handler.DetectAnnouncementChannels(conf, dcbot)
 
 	var tr *http.Transport
 
@@ -66,24 +190,28 @@ func main() {
 
 	fmt.Printf("Authorized on account @%s\n", tgbot.Self.UserName)
 
-	// Init database
-	db, err := database.NewDatabase(conf)
-	if err != nil {
-		fmt.Println("Database cannot be initialized! See, error:")
-		panic(err)
-	}
-
-	// Try auto migration for first start
-	err = db.AutoMigrate()
-	if err != nil {
-		fmt.Println("Cannot auto migrate! See, error:")
-		panic(err)
-	}
+	var updates tgbotapi.UpdatesChannel
+	var webhook *tgapi.Webhook
+	if conf.Telegram.Webhook != nil {
+		// Receive updates with webhook
+		webhook, err = tgapi.NewWebhook(conf, tgbot)
+		if err != nil {
+			fmt.Println("Telegram webhook cannot be set! See, error:")
+			panic(err)
+		}
+		updates = webhook.Updates
+	} else {
+		// Webhook left from previous run blocks getUpdates
+		if err := tgapi.DeleteWebhook(tgbot); err != nil {
+			fmt.Println("Telegram webhook cannot be deleted! See, error:")
+			panic(err)
+		}
 
-	uc := tgbotapi.NewUpdate(0)
-	uc.Timeout = 60
+		uc := tgbotapi.NewUpdate(0)
+		uc.Timeout = 60
 
-	updates := tgbot.GetUpdatesChan(uc)
+		updates = tgapi.GetUpdatesChan(tgbot, uc)
+	}
 
 	// Graceful shutdown
 	s := make(chan os.Signal, 1)
@@ -91,11 +219,24 @@ func main() {
 
 	go func() {
 		<-s
+		if webhook != nil {
+			webhook.Close()
+		}
 		updates.Clear()
 		dcbot.Close()
 		os.Exit(1)
 	}()
 
+	if conf.Metrics != "" {
+		go serveMetrics(conf.Metrics)
+	}
+
+	// Post from Discord to Telegram
+	handler.RunReverse(conf, db, client, tgbot, dcbot)
+
+	// Retry failed reposts
+	go handler.RunOutbox(conf, db, client, tgbot, dcbot)
+
 	// Main loop, check all changes in Telegram Channel
 	for u := range updates {
 		handler.HandleUpdate(conf, db, client, tgbot, dcbot, u)
@@ -1,7 +1,10 @@
 package tgapi
 
 import (
+	"bytes"
 	"fmt"
+	"net/url"
+	"strings"
 	"unicode/utf16"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -14,72 +17,100 @@ import (
 var needEscape = make(map[rune]struct{})
 
 func init() {
-	for _, r := range []rune{'_', '*', '[', ']', '(', ')', '~', '`', '>', '#', '+', '-', '=', '|', '{', '}', '.', '!'} {
+	for _, r := range []rune{'\\', '_', '*', '[', ']', '(', ')', '~', '`', '>', '#', '+', '-', '=', '|', '{', '}', '.', '!'} {
 		needEscape[r] = struct{}{}
 	}
 }
 
-// EntitiesToDiscordMarkdown converts plain text with Entities to Markdown and escapes Markdown special symbols (but it's not escapes those symbols in urls).
-// https://core.telegram.org/bots/api#messageentity
-func EntitiesToDiscordMarkdown(text string, messageEntities []tgbotapi.MessageEntity) string {
-	insertions := make(map[int]string)
-	noEscape := make(map[int]*struct{})
-	strct := struct{}{}
-	stopEscape := func(e *tgbotapi.MessageEntity) {
-		for i := e.Offset; i < e.Offset+e.Length; i++ {
-			noEscape[i] = &strct
-		}
+// MarkdownOptions tells which entities are turned into links to Telegram and how custom emoji are shown
+type MarkdownOptions struct {
+	// Link @username mentions and mentions of users having username
+	Mentions bool
+	// Link hashtags and cashtags to search in the channel
+	Hashtags bool
+	// Username of the channel searched by hashtags, they are not linked without it
+	Channel string
+	// Discord emoji (<:name:id>) replacing custom emoji by offset of their entities.
+	// Custom emoji not found here are shown as their Unicode alternative.
+	Emoji map[int]string
+	// Rewrite changes URLs of links and URLs shown in the text, nil keeps them
+	Rewrite func(url string) string
+}
+
+// entityLink returns Telegram link the entity is turned into, empty if it stays text
+func entityLink(text string, e *tgbotapi.MessageEntity, opts *MarkdownOptions) string {
+	if opts == nil {
+		return ""
 	}
 
-	for _, e := range messageEntities {
-		var before, after string
-
-		if e.IsBold() {
-			before = "**"
-			after = "**"
-		} else if e.IsItalic() {
-			before = "_"
-			after = "_"
-		} else if e.Type == "underline" {
-			before = "__"
-			after = "__"
-		} else if e.Type == "strikethrough" {
-			before = "~~"
-			after = "~~"
-		} else if e.IsCode() {
-			before = "`"
-			after = "`"
-			stopEscape(&e)
-		} else if e.IsPre() {
-			before = "```" + e.Language
-			after = "```"
-			stopEscape(&e)
-		} else if e.IsTextLink() {
-			before = "["
-			//after = fmt.Sprintf(`](%s "%s")`, e.URL, e.URL)
-			// this doesn't work anymore ↑
-			after = fmt.Sprintf(`](%s)`, e.URL)
-		} else if e.IsURL() {
-			stopEscape(&e)
+	switch e.Type {
+	case "mention":
+		if opts.Mentions {
+			return "https://t.me/" + strings.TrimPrefix(EntityText(text, *e), "@")
 		}
-		if before != "" {
-			insertions[e.Offset] += before
-			insertions[e.Offset+e.Length] = after + insertions[e.Offset+e.Length]
+	case "text_mention":
+		// tg://user?id= links are not opened from Discord, so only users with username are linked
+		if opts.Mentions && e.User != nil && e.User.UserName != "" {
+			return "https://t.me/" + e.User.UserName
+		}
+	case "hashtag", "cashtag":
+		if opts.Hashtags && opts.Channel != "" {
+			return fmt.Sprintf("https://t.me/s/%s?q=%s", opts.Channel, url.QueryEscape(EntityText(text, *e)))
 		}
 	}
 
-	input := []rune(text)
-	var output []rune
-	utf16pos := 0
-	for _, c := range input {
-		output = append(output, []rune(insertions[utf16pos])...)
-		_, stopEscaping := noEscape[utf16pos]
-		if _, has := needEscape[c]; has && !stopEscaping {
-			output = append(output, '\\')
-		}
-		output = append(output, c)
-		utf16pos += len(utf16.Encode([]rune{c}))
+	return ""
+}
+
+// rewrite returns the URL as the options change it
+func (o *MarkdownOptions) rewrite(url string) string {
+	if o == nil || o.Rewrite == nil {
+		return url
 	}
-	output = append(output, []rune(insertions[utf16pos])...)
-	return string(output)
+
+	return o.Rewrite(url)
+}
+
+// emoji returns Discord emoji replacing the custom emoji entity, empty if there is none
+func (o *MarkdownOptions) emoji(e *tgbotapi.MessageEntity) string {
+	if o == nil || e.Type != "custom_emoji" {
+		return ""
+	}
+
+	return o.Emoji[e.Offset]
+}
+
+// EntitiesToDiscordMarkdown converts plain text with Entities to Markdown and escapes Markdown special symbols (but it's not escapes those symbols in urls).
+// https://core.telegram.org/bots/api#messageentity
+func EntitiesToDiscordMarkdown(text string, messageEntities []tgbotapi.MessageEntity) string {
+	return EntitiesToDiscordMarkdownWithOptions(text, messageEntities, nil)
+}
+
+// EntitiesToDiscordMarkdownWithOptions is EntitiesToDiscordMarkdown also turning mentions and hashtags into links
+// and replacing custom emoji as the options tell. Nil options leave them as text.
+func EntitiesToDiscordMarkdownWithOptions(text string, messageEntities []tgbotapi.MessageEntity, opts *MarkdownOptions) string {
+	r := &renderer{
+		text: text,
+		src:  utf16.Encode([]rune(text)),
+		opts: opts,
+		out:  &bytes.Buffer{},
+	}
+	root := buildTree(r.src, normalizeEntities(r.src, messageEntities))
+	r.children(root, "")
+
+	return r.out.String()
+}
+
+// EntityText returns part of the text the entity is applied to. Offset and length of entity are in UTF-16 code units.
+func EntityText(text string, entity tgbotapi.MessageEntity) string {
+	encoded := utf16.Encode([]rune(text))
+	start, end := entity.Offset, entity.Offset+entity.Length
+	if start < 0 || start > len(encoded) {
+		return ""
+	}
+	if end > len(encoded) {
+		end = len(encoded)
+	}
+
+	return string(utf16.Decode(encoded[start:end]))
 }
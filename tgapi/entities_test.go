@@ -1,7 +1,10 @@
 package tgapi
 
 import (
+	"strings"
 	"testing"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -78,7 +81,7 @@ func TestEntities(t *testing.T) {
 					Length: 10,
 				},
 			},
-			Expected: "㊗️ Lorem ```markdownum``` temptabat",
+			Expected: "㊗️ Lorem ```\nmarkdownum\n``` temptabat",
 		},
 		"text_link": {
 			Text: "㊗️ Lorem markdownum temptabat",
@@ -90,7 +93,45 @@ func TestEntities(t *testing.T) {
 					URL:    "https://example.com/",
 				},
 			},
-			Expected: `㊗️ Lorem [markdownum](https://example.com/ "https://example.com/") temptabat`,
+			Expected: "㊗️ Lorem [markdownum](https://example.com/) temptabat",
+		},
+		"spoiler": {
+			Text: "㊗️ Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "spoiler",
+					Offset: 9,
+					Length: 10,
+				},
+			},
+			Expected: "㊗️ Lorem ||markdownum|| temptabat",
+		},
+		"blockquote": {
+			Text: "Intro\nfirst > line\nsecond line\nOutro",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "blockquote",
+					Offset: 6,
+					Length: 25,
+				},
+				{
+					Type:   "bold",
+					Offset: 14,
+					Length: 11,
+				},
+			},
+			Expected: "Intro\n> first \\> **line**\n> **second** line\nOutro",
+		},
+		"expandable_blockquote": {
+			Text: "Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "expandable_blockquote",
+					Offset: 6,
+					Length: 10,
+				},
+			},
+			Expected: "Lorem \n> markdownum\n temptabat",
 		},
 		"hashtag": {
 			Text: "㊗️ Lorem markdownum temptabat",
@@ -139,7 +180,79 @@ func TestEntities(t *testing.T) {
 					Length: 11,
 				},
 			},
-			Expected: `**㊗️ Lorem**_ markdownum_ temptabat`,
+			Expected: `**㊗️ Lorem** _markdownum_ temptabat`,
+		},
+		"pre language": {
+			Text: "Lorem\nfmt.Println(1)\n",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:     "pre",
+					Offset:   6,
+					Length:   15,
+					Language: "go",
+				},
+			},
+			Expected: "Lorem\n```go\nfmt.Println(1)\n\n```",
+		},
+		"same end": {
+			Text: "㊗️ Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "bold",
+					Offset: 3,
+					Length: 16,
+				},
+				{
+					Type:   "italic",
+					Offset: 9,
+					Length: 10,
+				},
+			},
+			Expected: "㊗️ **Lorem _markdownum_** temptabat",
+		},
+		"overlapping": {
+			Text: "㊗️ Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "bold",
+					Offset: 3,
+					Length: 16,
+				},
+				{
+					Type:   "strikethrough",
+					Offset: 9,
+					Length: 20,
+				},
+			},
+			Expected: "㊗️ **Lorem ~~markdownum~~** ~~temptabat~~",
+		},
+		"intraword italic": {
+			Text: "㊗️ Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "italic",
+					Offset: 13,
+					Length: 4,
+				},
+			},
+			Expected: "㊗️ Lorem mark*down*um temptabat",
+		},
+		"link with markdown": {
+			Text: "㊗️ Lorem [markdownum] temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "text_link",
+					Offset: 9,
+					Length: 12,
+					URL:    "https://en.wikipedia.org/wiki/Lorem_(ipsum)",
+				},
+				{
+					Type:   "bold",
+					Offset: 10,
+					Length: 10,
+				},
+			},
+			Expected: "㊗️ Lorem [\\[**markdownum**\\]](https://en.wikipedia.org/wiki/Lorem_%28ipsum%29) temptabat",
 		},
 		"complex": {
 			Text: "Lorem markdownum _temptabat usus rapta_ superesse uno segetes reponere decens,\n#carinae ~__*quis*__~.",
@@ -191,7 +304,7 @@ func TestEntities(t *testing.T) {
 					Length: 8,
 				},
 			},
-			Expected: "**_Lorem_** _markdownum_ \\_temptabat __usus__ rapta\\_ ~~superesse~~ `uno` [**segetes**](https://example.com/ \"https://example.com/\") reponere decens,\n\\#carinae \\~\\_\\_\\*quis\\*\\_\\_\\~\\.",
+			Expected: "**_Lorem_** _markdownum_ \\_temptabat __usus__ rapta\\_ ~~superesse~~ `uno` [**segetes**](https://example.com/) reponere decens,\n\\#carinae \\~\\_\\_\\*quis\\*\\_\\_\\~\\.",
 		},
 	}
 
@@ -204,3 +317,168 @@ func TestEntities(t *testing.T) {
 		})
 	}
 }
+
+func TestEntityOptions(t *testing.T) {
+	opts := &MarkdownOptions{Mentions: true, Hashtags: true, Channel: "lorem", Emoji: map[int]string{9: "<:lorem:123>"}}
+	cases := map[string]TestCase{
+		"mention": {
+			Text: "㊗️ Lorem @markdown_num temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "mention",
+					Offset: 9,
+					Length: 13,
+				},
+			},
+			Expected: "㊗️ Lorem [@markdown\\_num](https://t.me/markdown_num) temptabat",
+		},
+		"text_mention": {
+			Text: "㊗️ Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "text_mention",
+					Offset: 9,
+					Length: 10,
+					User:   &tgbotapi.User{ID: 42, UserName: "markdownum"},
+				},
+			},
+			Expected: "㊗️ Lorem [markdownum](https://t.me/markdownum) temptabat",
+		},
+		"text_mention without username": {
+			Text: "㊗️ Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "text_mention",
+					Offset: 9,
+					Length: 10,
+					User:   &tgbotapi.User{ID: 42},
+				},
+			},
+			Expected: "㊗️ Lorem markdownum temptabat",
+		},
+		"hashtag": {
+			Text: "㊗️ Lorem #markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "hashtag",
+					Offset: 9,
+					Length: 11,
+				},
+			},
+			Expected: "㊗️ Lorem [\\#markdownum](https://t.me/s/lorem?q=%23markdownum) temptabat",
+		},
+		"cashtag": {
+			Text: "㊗️ Lorem $USD temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "cashtag",
+					Offset: 9,
+					Length: 4,
+				},
+			},
+			Expected: "㊗️ Lorem [$USD](https://t.me/s/lorem?q=%24USD) temptabat",
+		},
+		"custom_emoji": {
+			Text: "㊗️ Lorem 👍 temptabat 👎",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "custom_emoji",
+					Offset: 9,
+					Length: 2,
+				},
+				{
+					Type:   "custom_emoji",
+					Offset: 22,
+					Length: 2,
+				},
+			},
+			Expected: "㊗️ Lorem <:lorem:123> temptabat 👎",
+		},
+	}
+
+	for casename, testcase := range cases {
+		t.Run(casename, func(t *testing.T) {
+			actual := EntitiesToDiscordMarkdownWithOptions(testcase.Text, testcase.Entities, opts)
+			if actual != testcase.Expected {
+				t.Fatalf("\nExpected:\n\"%s\"\n\nGot:\n\"%s\"", testcase.Expected, actual)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		text := "@lorem #markdownum"
+		entities := []tgbotapi.MessageEntity{
+			{Type: "mention", Offset: 0, Length: 6},
+			{Type: "hashtag", Offset: 7, Length: 11},
+		}
+		expected := "@lorem \\#markdownum"
+		actual := EntitiesToDiscordMarkdownWithOptions(text, entities, &MarkdownOptions{Hashtags: true})
+		if actual != expected {
+			t.Fatalf("\nExpected:\n\"%s\"\n\nGot:\n\"%s\"", expected, actual)
+		}
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		text := "Lorem example.com markdownum"
+		entities := []tgbotapi.MessageEntity{
+			{Type: "text_link", Offset: 0, Length: 5, URL: "https://example.com/lorem"},
+			{Type: "url", Offset: 6, Length: 11},
+		}
+		expected := "[Lorem](https://example.org/lorem) example.org markdownum"
+		rewrite := func(url string) string {
+			return strings.Replace(url, "example.com", "example.org", 1)
+		}
+		actual := EntitiesToDiscordMarkdownWithOptions(text, entities, &MarkdownOptions{Rewrite: rewrite})
+		if actual != expected {
+			t.Fatalf("\nExpected:\n\"%s\"\n\nGot:\n\"%s\"", expected, actual)
+		}
+	})
+}
+
+// FuzzEntitiesToDiscordMarkdown checks that markdown is well-formed: Discord shows exactly the text of the post,
+// every marker is paired and no text is taken as markdown.
+func FuzzEntitiesToDiscordMarkdown(f *testing.F) {
+	types := []string{"bold", "italic", "underline", "strikethrough", "spoiler", "code", "pre", "text_link", "blockquote"}
+
+	f.Add("㊗️ Lorem markdownum temptabat", []byte{0, 3, 16, 2, 9, 10})
+	f.Add("Lorem *markdownum* [temptabat](usus)", []byte{1, 0, 18, 7, 6, 20, 3, 19, 10})
+	f.Add("Intro\nfirst > line\nsecond line\nOutro", []byte{8, 6, 25, 0, 14, 11, 6, 19, 6})
+	f.Add("a_b\\c `d` ```e```", []byte{1, 1, 3, 5, 4, 5, 4, 9, 8})
+
+	f.Fuzz(func(t *testing.T, text string, spec []byte) {
+		if !utf8.ValidString(text) {
+			return
+		}
+		src := utf16.Encode([]rune(text))
+		var entities []tgbotapi.MessageEntity
+		for i := 0; i+2 < len(spec); i += 3 {
+			e := tgbotapi.MessageEntity{
+				Type:   types[int(spec[i])%len(types)],
+				Offset: int(spec[i+1]),
+				Length: int(spec[i+2]),
+				URL:    "https://example.com/a_(b)",
+			}
+			// Quotes are on their own lines, otherwise line breaks are added around them
+			if e.Type == "blockquote" {
+				start, end := e.Offset, e.Offset+e.Length
+				if start > len(src) {
+					start = len(src)
+				}
+				for start > 0 && src[start-1] != '\n' {
+					start--
+				}
+				for end < len(src) && (end == 0 || src[end-1] != '\n') {
+					end++
+				}
+				e.Offset, e.Length = start, end-start
+			}
+			entities = append(entities, e)
+		}
+
+		markdown := EntitiesToDiscordMarkdown(text, entities)
+		actual, _ := DiscordMarkdownToEntities(markdown)
+		if actual != text {
+			t.Fatalf("\nText:\n%q\n\nEntities:\n%+v\n\nMarkdown:\n%q\n\nShown as:\n%q", text, entities, markdown, actual)
+		}
+	})
+}
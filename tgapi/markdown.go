@@ -0,0 +1,388 @@
+package tgapi
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Discord markdown delimiters and Telegram entities they become, longer delimiters go first
+var markdownDelimiters = []struct {
+	Delimiter string
+	Type      string
+}{
+	{"**", "bold"},
+	{"__", "underline"},
+	{"~~", "strikethrough"},
+	{"||", "spoiler"},
+	{"*", "italic"},
+	{"_", "italic"},
+}
+
+// markdownParser converts Discord markdown to plain text with entities.
+// Delimiters without closing pair are kept as text.
+type markdownParser struct {
+	src      []rune
+	pos      int
+	out      []rune
+	offset   int // length of out in UTF-16 code units
+	entities []tgbotapi.MessageEntity
+	// Text is a part of line
+	inline bool
+}
+
+func (p *markdownParser) write(runes ...rune) {
+	p.out = append(p.out, runes...)
+	p.offset += len(utf16.Encode(runes))
+}
+
+func (p *markdownParser) hasPrefix(prefix string) bool {
+	return p.hasPrefixAt(p.pos, prefix)
+}
+
+func (p *markdownParser) hasPrefixAt(i int, prefix string) bool {
+	for _, r := range prefix {
+		if i >= len(p.src) || p.src[i] != r {
+			return false
+		}
+		i++
+	}
+
+	return true
+}
+
+func (p *markdownParser) index(s string, from int) int {
+	if from > len(p.src) {
+		return -1
+	}
+	i := strings.Index(string(p.src[from:]), s)
+	if i < 0 {
+		return -1
+	}
+
+	return from + len([]rune(string(p.src[from:])[:i]))
+}
+
+func (p *markdownParser) atLineStart() bool {
+	return p.pos == 0 || p.src[p.pos-1] == '\n'
+}
+
+func (p *markdownParser) addEntity(entityType string, start int) *tgbotapi.MessageEntity {
+	p.entities = append(p.entities, tgbotapi.MessageEntity{
+		Type:   entityType,
+		Offset: start,
+		Length: p.offset - start,
+	})
+
+	return &p.entities[len(p.entities)-1]
+}
+
+// code parses inline code and code blocks, reports whether there was one at the position
+func (p *markdownParser) code() bool {
+	if p.hasPrefix("```") {
+		end := p.index("```", p.pos+3)
+		if end < 0 {
+			return false
+		}
+		content := string(p.src[p.pos+3 : end])
+		// The first line is language if there is something on the next lines
+		language := ""
+		if i := strings.IndexByte(content, '\n'); i >= 0 {
+			if first := content[:i]; !strings.ContainsAny(first, " \t") {
+				language, content = first, content[i+1:]
+			}
+		}
+		start := p.offset
+		p.write([]rune(strings.TrimSuffix(content, "\n"))...)
+		p.addEntity("pre", start).Language = language
+		p.pos = end + 3
+		return true
+	}
+
+	if p.hasPrefix("`") {
+		end := p.index("`", p.pos+1)
+		if end <= p.pos+1 {
+			return false
+		}
+		start := p.offset
+		p.write(p.src[p.pos+1 : end]...)
+		p.addEntity("code", start)
+		p.pos = end + 1
+		return true
+	}
+
+	return false
+}
+
+// link parses masked link [text](url), reports whether there was one at the position
+func (p *markdownParser) link() bool {
+	if !p.hasPrefix("[") {
+		return false
+	}
+
+	// Text of the link ends with the first not escaped "]("
+	end := -1
+	for i := p.pos + 1; i+1 < len(p.src); i++ {
+		if p.src[i] == '\\' {
+			i++
+			continue
+		}
+		if p.src[i] == ']' && p.src[i+1] == '(' {
+			end = i
+			break
+		}
+	}
+	if end <= p.pos+1 {
+		return false
+	}
+	urlEnd := p.index(")", end+2)
+	if urlEnd < 0 {
+		return false
+	}
+	url := strings.Trim(string(p.src[end+2:urlEnd]), "<>")
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") || strings.ContainsAny(url, " \n") {
+		return false
+	}
+
+	start := p.offset
+	p.inner(p.src[p.pos+1 : end])
+	p.addEntity("text_link", start).URL = url
+	p.pos = urlEnd + 1
+
+	return true
+}
+
+// delimited parses text between paired delimiters, reports whether there was one at the position.
+// As Discord does, the longest of delimited texts starting at the position is taken.
+func (p *markdownParser) delimited() bool {
+	var delimiter, entityType string
+	closing := -1
+	for _, d := range markdownDelimiters {
+		if !p.hasPrefix(d.Delimiter) || !p.canOpen(d.Delimiter) {
+			continue
+		}
+		if c := p.closingOf(d.Delimiter, p.pos+len([]rune(d.Delimiter))); c > closing {
+			delimiter, entityType, closing = d.Delimiter, d.Type, c
+		}
+	}
+	if closing < 0 {
+		return false
+	}
+
+	start := p.offset
+	p.inner(p.src[p.pos+len([]rune(delimiter)) : closing])
+	p.addEntity(entityType, start)
+	p.pos = closing + len([]rune(delimiter))
+
+	return true
+}
+
+// at returns symbol at the position, -1 outside of the text
+func (p *markdownParser) at(i int) rune {
+	if i < 0 || i >= len(p.src) {
+		return -1
+	}
+
+	return p.src[i]
+}
+
+// isWordRune reports that the symbol is a part of word for Discord, so underscore next to it is not italic marker
+func isWordRune(c rune) bool {
+	return c == '_' || c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c))
+}
+
+// canOpen reports that the delimiter at the position may start delimited text
+func (p *markdownParser) canOpen(d string) bool {
+	next := p.at(p.pos + len([]rune(d)))
+	switch d {
+	case "*", "~~":
+		return next >= 0 && !unicode.IsSpace(next)
+	case "_":
+		return !isWordRune(p.at(p.pos - 1))
+	}
+
+	return true
+}
+
+// closingOf returns position of the nearest delimiter closing text starting at the position, -1 if there is none.
+// Escaped symbols are skipped, text between delimiters is not empty.
+func (p *markdownParser) closingOf(d string, from int) int {
+	for i := from; i < len(p.src); i++ {
+		if p.src[i] == '\\' {
+			i++
+			continue
+		}
+		if !p.hasPrefixAt(i, d) {
+			continue
+		}
+
+		next := p.at(i + len([]rune(d)))
+		switch d {
+		case "**", "__":
+			// Delimiter is the last two of three symbols
+			if i == from || next == rune(d[0]) {
+				continue
+			}
+		case "~~":
+			if i == from || unicode.IsSpace(p.src[i-1]) {
+				continue
+			}
+		case "*", "_":
+			// Doubled delimiters are a part of the text, single ones cannot be
+			if next == rune(d[0]) {
+				i++
+				continue
+			}
+			if i == from || d == "*" && unicode.IsSpace(p.src[i-1]) || d == "_" && isWordRune(next) {
+				return -1
+			}
+		case "||":
+			if i == from {
+				continue
+			}
+		}
+
+		return i
+	}
+
+	return -1
+}
+
+// inner parses text nested in other markdown: it is a part of line, so quotes and headers are not parsed in it
+func (p *markdownParser) inner(src []rune) {
+	nested := &markdownParser{
+		src:    src,
+		inline: true,
+	}
+	nested.parse("")
+	p.embed(nested)
+}
+
+// embed writes text and entities parsed by the other parser
+func (p *markdownParser) embed(nested *markdownParser) {
+	start := p.offset
+	p.write(nested.out...)
+	for _, e := range nested.entities {
+		e.Offset += start
+		p.entities = append(p.entities, e)
+	}
+}
+
+// lineStart parses quotes and headers at the beginning of the line, reports whether there was one
+func (p *markdownParser) lineStart() bool {
+	if p.inline || !p.atLineStart() {
+		return false
+	}
+
+	// The rest of the message is quoted
+	if p.hasPrefix(">>> ") {
+		p.pos += 4
+		start := p.offset
+		p.parse("")
+		p.addEntity("blockquote", start)
+		return true
+	}
+	if p.hasPrefix("> ") {
+		p.quote()
+		return true
+	}
+	if !p.hasPrefix("# ") && !p.hasPrefix("## ") && !p.hasPrefix("### ") {
+		return false
+	}
+
+	p.pos += len([]rune(strings.SplitAfterN(string(p.src[p.pos:]), " ", 2)[0]))
+	start := p.offset
+	closed := p.parse("\n")
+	if p.offset > start {
+		p.addEntity("bold", start)
+	}
+	if closed {
+		p.write('\n')
+	}
+
+	return true
+}
+
+// quote parses consecutive quoted lines. Their content is parsed as a whole, so code blocks may span the lines.
+func (p *markdownParser) quote() {
+	var lines []string
+	closed := false
+	for p.hasPrefix("> ") {
+		p.pos += 2
+		end := p.index("\n", p.pos)
+		if end < 0 {
+			lines = append(lines, string(p.src[p.pos:]))
+			p.pos, closed = len(p.src), false
+			break
+		}
+		lines = append(lines, string(p.src[p.pos:end]))
+		p.pos, closed = end+1, true
+	}
+
+	quoted := &markdownParser{
+		src: []rune(strings.Join(lines, "\n")),
+	}
+	quoted.parse("")
+
+	start := p.offset
+	p.embed(quoted)
+	if p.offset > start {
+		p.addEntity("blockquote", start)
+	}
+	if closed {
+		p.write('\n')
+	}
+}
+
+// isEscapable reports that backslash before the symbol makes it plain text, as Discord does with any symbol
+// except ASCII letters, digits and whitespace
+func isEscapable(c rune) bool {
+	return !unicode.IsSpace(c) && !(c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)))
+}
+
+// parse converts markdown until the closing delimiter, reports whether it was found.
+// Empty closing parses the text to the end.
+func (p *markdownParser) parse(closing string) bool {
+	for p.pos < len(p.src) {
+		if closing != "" && p.hasPrefix(closing) {
+			p.pos += len([]rune(closing))
+			return true
+		}
+
+		c := p.src[p.pos]
+		if c == '\\' && p.pos+1 < len(p.src) && isEscapable(p.src[p.pos+1]) {
+			p.write(p.src[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if p.lineStart() || p.code() || p.link() || p.delimited() {
+			continue
+		}
+
+		p.write(c)
+		p.pos++
+	}
+
+	return closing == ""
+}
+
+// DiscordMarkdownToEntities converts Discord markdown to plain text with Telegram entities.
+// https://support.discord.com/hc/en-us/articles/210298617
+func DiscordMarkdownToEntities(text string) (string, []tgbotapi.MessageEntity) {
+	p := &markdownParser{
+		src: []rune(text),
+	}
+	p.parse("")
+
+	sort.SliceStable(p.entities, func(i, j int) bool {
+		if p.entities[i].Offset != p.entities[j].Offset {
+			return p.entities[i].Offset < p.entities[j].Offset
+		}
+		return p.entities[i].Length > p.entities[j].Length
+	})
+
+	return string(p.out), p.entities
+}
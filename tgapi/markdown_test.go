@@ -0,0 +1,123 @@
+package tgapi
+
+import (
+	"reflect"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestDiscordMarkdownToEntities(t *testing.T) {
+	cases := map[string]TestCase{
+		"bold": {
+			Text: "㊗️ Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "bold",
+					Offset: 9,
+					Length: 10,
+				},
+			},
+			Expected: "㊗️ Lorem **markdownum** temptabat",
+		},
+		"nested": {
+			Text: "Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "bold",
+					Offset: 6,
+					Length: 20,
+				},
+				{
+					Type:   "italic",
+					Offset: 6,
+					Length: 10,
+				},
+			},
+			Expected: "Lorem **_markdownum_ temptabat**",
+		},
+		"text_link": {
+			Text: "Lorem markdownum temptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "text_link",
+					Offset: 6,
+					Length: 10,
+					URL:    "https://example.com",
+				},
+			},
+			Expected: "Lorem [markdownum](https://example.com) temptabat",
+		},
+		"pre": {
+			Text: "fmt.Println()",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:     "pre",
+					Offset:   0,
+					Length:   13,
+					Language: "go",
+				},
+			},
+			Expected: "```go\nfmt.Println()\n```",
+		},
+		"quote": {
+			Text: "Lorem\nmarkdownum\ntemptabat",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "blockquote",
+					Offset: 0,
+					Length: 16,
+				},
+			},
+			Expected: "> Lorem\n> markdownum\ntemptabat",
+		},
+		"quoted code": {
+			Text: "fmt.Println()",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:     "pre",
+					Offset:   0,
+					Length:   13,
+					Language: "go",
+				},
+				{
+					Type:   "blockquote",
+					Offset: 0,
+					Length: 13,
+				},
+			},
+			Expected: "> ```go\n> fmt.Println()\n> ```",
+		},
+		"longest": {
+			Text: "Lorem markdownum",
+			Entities: []tgbotapi.MessageEntity{
+				{
+					Type:   "italic",
+					Offset: 0,
+					Length: 16,
+				},
+				{
+					Type:   "bold",
+					Offset: 0,
+					Length: 5,
+				},
+			},
+			Expected: "***Lorem** markdownum*",
+		},
+		"not closed": {
+			Text:     "snake_case **Lorem",
+			Expected: "snake_case **Lorem",
+		},
+		"escaped": {
+			Text:     "*Lorem*",
+			Expected: "\\*Lorem\\*",
+		},
+	}
+
+	for name, c := range cases {
+		text, entities := DiscordMarkdownToEntities(c.Expected)
+		if text != c.Text || !reflect.DeepEqual(entities, c.Entities) {
+			t.Errorf("%s: got %q %+v, expected %q %+v", name, text, entities, c.Text, c.Entities)
+		}
+	}
+}
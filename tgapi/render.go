@@ -0,0 +1,489 @@
+package tgapi
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Markers of entities wrapping formatted text
+var formatMarkers = map[string]string{
+	"bold":          "**",
+	"italic":        "_",
+	"underline":     "__",
+	"strikethrough": "~~",
+	"spoiler":       "||",
+}
+
+// Entities of the same range are nested in this order, unknown ones go last
+var entityPriority = map[string]int{
+	"blockquote":            1,
+	"expandable_blockquote": 1,
+	"text_link":             2,
+	"mention":               2,
+	"text_mention":          2,
+	"hashtag":               2,
+	"cashtag":               2,
+	"bold":                  3,
+	"underline":             4,
+	"italic":                5,
+	"strikethrough":         6,
+	"spoiler":               7,
+	"custom_emoji":          8,
+	"url":                   8,
+	"code":                  9,
+	"pre":                   9,
+}
+
+func isQuote(e *tgbotapi.MessageEntity) bool {
+	return e.Type == "blockquote" || e.Type == "expandable_blockquote"
+}
+
+// isFormat reports that the entity formats part of line: Discord cannot continue it on the next line of quote
+// and whitespace around formatted text is left outside of markers.
+func isFormat(e *tgbotapi.MessageEntity) bool {
+	_, ok := formatMarkers[e.Type]
+	return ok || e.Type == "text_link"
+}
+
+func priority(e *tgbotapi.MessageEntity) int {
+	if p, ok := entityPriority[e.Type]; ok {
+		return p
+	}
+
+	return len(entityPriority) + 1
+}
+
+// entityLess orders entities so that outer ones go before entities nested in them
+func entityLess(a, b *tgbotapi.MessageEntity) bool {
+	if a.Offset != b.Offset {
+		return a.Offset < b.Offset
+	}
+	if a.Length != b.Length {
+		return a.Length > b.Length
+	}
+
+	return priority(a) < priority(b)
+}
+
+func isSpace(c uint16) bool {
+	return unicode.IsSpace(rune(c))
+}
+
+// trimSpace leaves whitespace around formatted text outside of the formatting entity
+func trimSpace(src []uint16, e *tgbotapi.MessageEntity) {
+	if !isFormat(e) {
+		return
+	}
+
+	start, end := e.Offset, e.Offset+e.Length
+	for start < end && isSpace(src[start]) {
+		start++
+	}
+	for end > start && isSpace(src[end-1]) {
+		end--
+	}
+	e.Offset, e.Length = start, end-start
+}
+
+// normalizeEntities prepares entities to be rendered:
+// entities are cut to the text and do not split surrogate pairs,
+// overlapping and adjacent entities of the same formatting are merged,
+// formatting does not cross quote boundaries and lines of quotes,
+// whitespace around formatted text is left outside of it.
+func normalizeEntities(src []uint16, messageEntities []tgbotapi.MessageEntity) []tgbotapi.MessageEntity {
+	var entities []tgbotapi.MessageEntity
+	for _, e := range messageEntities {
+		start, end := e.Offset, e.Offset+e.Length
+		if start < 0 {
+			start = 0
+		}
+		if end > len(src) {
+			end = len(src)
+		}
+		if start > 0 && start < len(src) && utf16.IsSurrogate(rune(src[start])) && src[start] >= 0xdc00 {
+			start--
+		}
+		if end > 0 && end < len(src) && utf16.IsSurrogate(rune(src[end])) && src[end] >= 0xdc00 {
+			end++
+		}
+		if start >= end {
+			continue
+		}
+		e.Offset, e.Length = start, end-start
+		entities = append(entities, e)
+	}
+
+	entities = mergeEntities(entities)
+	entities = splitByQuotes(src, entities)
+
+	var result []tgbotapi.MessageEntity
+	for _, e := range entities {
+		trimSpace(src, &e)
+		if e.Length > 0 {
+			result = append(result, e)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return entityLess(&result[i], &result[j])
+	})
+
+	return result
+}
+
+// mergeEntities merges overlapping and adjacent entities of the same formatting, or links to the same URL
+func mergeEntities(entities []tgbotapi.MessageEntity) []tgbotapi.MessageEntity {
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Offset < entities[j].Offset
+	})
+
+	var result []tgbotapi.MessageEntity
+	last := make(map[string]int)
+	for _, e := range entities {
+		key := e.Type + " " + e.URL
+		if i, ok := last[key]; ok && isFormat(&e) {
+			prev := &result[i]
+			if e.Offset <= prev.Offset+prev.Length {
+				if end := e.Offset + e.Length; end > prev.Offset+prev.Length {
+					prev.Length = end - prev.Offset
+				}
+				continue
+			}
+		}
+		last[key] = len(result)
+		result = append(result, e)
+	}
+
+	return result
+}
+
+// splitByQuotes cuts entities at boundaries of quotes, and formatting at line breaks inside quotes
+func splitByQuotes(src []uint16, entities []tgbotapi.MessageEntity) []tgbotapi.MessageEntity {
+	cuts := make(map[int]struct{})
+	// Line breaks inside quotes, except the last one
+	breaks := make(map[int]struct{})
+	// Line breaks around quotes, markers next to them would go to the quoted lines
+	boundaries := make(map[int]struct{})
+	for _, e := range entities {
+		if !isQuote(&e) {
+			continue
+		}
+		start, end := e.Offset, e.Offset+e.Length
+		cuts[start] = struct{}{}
+		cuts[end] = struct{}{}
+		for i := start; i < end-1; i++ {
+			if src[i] == '\n' {
+				breaks[i] = struct{}{}
+			}
+		}
+		for _, i := range []int{start - 1, end - 1, end} {
+			if i >= 0 && i < len(src) && src[i] == '\n' {
+				boundaries[i] = struct{}{}
+			}
+		}
+	}
+	if len(cuts) == 0 {
+		return entities
+	}
+
+	var result []tgbotapi.MessageEntity
+	for _, e := range entities {
+		if isQuote(&e) {
+			result = append(result, e)
+			continue
+		}
+
+		start, end := e.Offset, e.Offset+e.Length
+		for i := start; i < end; i++ {
+			_, cut := cuts[i]
+			_, lineBreak := breaks[i]
+			_, boundary := boundaries[i]
+			lineBreak = lineBreak && isFormat(&e) || boundary
+			if !cut && !lineBreak {
+				continue
+			}
+			if i > start {
+				part := e
+				part.Offset, part.Length = start, i-start
+				result = append(result, part)
+			}
+			start = i
+			// Line break itself is not formatted
+			if lineBreak {
+				start = i + 1
+			}
+		}
+		if end > start {
+			e.Offset, e.Length = start, end-start
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// node is an entity with entities nested in it
+type node struct {
+	entity     *tgbotapi.MessageEntity
+	start, end int
+	children   []*node
+}
+
+// buildTree nests sorted entities into each other. Entity crossing boundary of the outer one is split in two.
+func buildTree(src []uint16, entities []tgbotapi.MessageEntity) *node {
+	root := &node{end: len(src)}
+	stack := []*node{root}
+
+	queue := append([]tgbotapi.MessageEntity{}, entities...)
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+
+		for len(stack) > 1 && stack[len(stack)-1].end <= e.Offset {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+
+		if end := e.Offset + e.Length; end > parent.end {
+			rest := e
+			rest.Offset, rest.Length = parent.end, end-parent.end
+			trimSpace(src, &rest)
+			if rest.Length > 0 {
+				i := sort.Search(len(queue), func(i int) bool {
+					return entityLess(&rest, &queue[i])
+				})
+				queue = append(queue[:i], append([]tgbotapi.MessageEntity{rest}, queue[i:]...)...)
+			}
+			e.Length = parent.end - e.Offset
+			trimSpace(src, &e)
+			if e.Length == 0 {
+				continue
+			}
+		}
+
+		child := &node{entity: &e, start: e.Offset, end: e.Offset + e.Length}
+		parent.children = append(parent.children, child)
+		stack = append(stack, child)
+	}
+
+	return root
+}
+
+// renderer writes entity tree as Discord markdown
+type renderer struct {
+	text string
+	src  []uint16
+	opts *MarkdownOptions
+	out  *bytes.Buffer
+	// Inside of masked link, other links are rendered as text
+	inLink bool
+	// Markers of formatting the text is in, they cannot appear in code and URLs
+	markers string
+	// Formatting closed last and length of output after it, so adjacent formatting of the same type is joined
+	closed   string
+	closedAt int
+}
+
+func (r *renderer) raw(start, end int) string {
+	return string(utf16.Decode(r.src[start:end]))
+}
+
+// escaped writes the text escaping Markdown special symbols
+func (r *renderer) escaped(start, end int) {
+	for _, c := range r.raw(start, end) {
+		if _, ok := needEscape[c]; ok {
+			r.out.WriteRune('\\')
+		}
+		r.out.WriteRune(c)
+	}
+}
+
+// opening returns marker the entity starts with, empty if it is not known before the entity is written
+func opening(n *node) string {
+	e := n.entity
+	switch {
+	case e.Type == "italic":
+		return ""
+	case formatMarkers[e.Type] != "":
+		return formatMarkers[e.Type]
+	case e.Type == "code", e.Type == "pre":
+		return "`"
+	case e.Type == "text_link":
+		return "["
+	}
+
+	return ""
+}
+
+// children writes text of the node with the nested entities. Follow is markdown written after the node.
+func (r *renderer) children(n *node, follow string) {
+	pos := n.start
+	for i, c := range n.children {
+		r.escaped(pos, c.start)
+
+		// What goes right after the nested entity
+		next := ""
+		if i+1 < len(n.children) && n.children[i+1].start == c.end {
+			next = opening(n.children[i+1])
+		} else if c.end == n.end {
+			next = follow
+		}
+		r.node(c, next)
+		pos = c.end
+	}
+	r.escaped(pos, n.end)
+}
+
+// lastRune returns the last written symbol, -1 if nothing is written
+func (r *renderer) lastRune() rune {
+	if r.out.Len() == 0 {
+		return -1
+	}
+	c, _ := utf8.DecodeLastRune(r.out.Bytes())
+
+	return c
+}
+
+// nextRune returns symbol written after the position, -1 if there is none
+func (r *renderer) nextRune(pos int, follow string) rune {
+	if follow != "" {
+		c, _ := utf8.DecodeRuneInString(follow)
+		return c
+	}
+	if pos >= len(r.src) {
+		return -1
+	}
+	end := pos + 2
+	if end > len(r.src) {
+		end = len(r.src)
+	}
+	c, _ := utf8.DecodeRuneInString(r.raw(pos, end))
+	if _, ok := needEscape[c]; ok {
+		return '\\'
+	}
+
+	return c
+}
+
+// italicMarker returns marker of italic which is not taken as a part of word or of other markers next to it.
+// Empty if there is no such marker.
+func (r *renderer) italicMarker(n *node, follow string) string {
+	prev, next := r.lastRune(), r.nextRune(n.end, follow)
+	if !isWordRune(prev) && !isWordRune(next) {
+		return "_"
+	}
+	if prev != '*' && next != '*' {
+		return "*"
+	}
+
+	return ""
+}
+
+func (r *renderer) node(n *node, follow string) {
+	e := n.entity
+	if marker, ok := formatMarkers[e.Type]; ok {
+		if e.Type == "italic" {
+			marker = r.italicMarker(n, follow)
+		}
+		if marker == "" {
+			r.children(n, follow)
+			return
+		}
+		// Split parts of the same formatting are written as one, so markers do not stick together
+		if r.closed == marker && r.closedAt == r.out.Len() {
+			r.out.Truncate(r.out.Len() - len(marker))
+		} else {
+			r.out.WriteString(marker)
+		}
+		outer := r.markers
+		r.markers += marker
+		r.children(n, marker+follow)
+		r.out.WriteString(marker)
+		r.markers = outer
+		r.closed, r.closedAt = marker, r.out.Len()
+		return
+	}
+
+	// Symbols cannot be escaped inside code, so code which would end the formatting it is in is shown as text
+	switch {
+	case e.Type == "code":
+		if content := r.raw(n.start, n.end); !strings.ContainsAny(content, "`"+r.markers) {
+			r.out.WriteString("`" + content + "`")
+			return
+		}
+	case e.Type == "pre":
+		if content := r.raw(n.start, n.end); !strings.Contains(content, "```") && !strings.ContainsAny(content, r.markers) {
+			r.out.WriteString("```" + e.Language + "\n" + content + "\n```")
+			return
+		}
+	case e.Type == "url":
+		r.out.WriteString(r.opts.rewrite(r.raw(n.start, n.end)))
+		return
+	case isQuote(e):
+		r.quote(n)
+		return
+	case r.opts.emoji(e) != "":
+		r.out.WriteString(r.opts.emoji(e))
+		return
+	default:
+		url := entityLink(r.text, e, r.opts)
+		if e.Type == "text_link" {
+			url = r.opts.rewrite(e.URL)
+		}
+		if !r.inLink && (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
+			r.link(n, url)
+			return
+		}
+	}
+
+	r.children(n, follow)
+}
+
+// escapeURL encodes symbols of URL which would end it or markdown the link is in
+func (r *renderer) escapeURL(url string) string {
+	var result strings.Builder
+	for _, c := range url {
+		if c == '(' || c == ')' || c == ' ' || strings.ContainsRune(r.markers, c) {
+			fmt.Fprintf(&result, "%%%02X", c)
+		} else {
+			result.WriteRune(c)
+		}
+	}
+
+	return result.String()
+}
+
+// link writes masked link
+func (r *renderer) link(n *node, url string) {
+	r.inLink = true
+	r.out.WriteString("[")
+	r.children(n, "]")
+	r.out.WriteString("](" + r.escapeURL(url) + ")")
+	r.inLink = false
+}
+
+// quote writes every line of the quote prefixed with "> ". Quote starts and ends on its own lines.
+func (r *renderer) quote(n *node) {
+	outer := r.out
+	r.out = &bytes.Buffer{}
+	r.children(n, "")
+	content := r.out.String()
+	r.out = outer
+	r.closed = ""
+
+	if n.start > 0 && r.src[n.start-1] != '\n' {
+		r.out.WriteString("\n")
+	}
+	trailingBreak := strings.HasSuffix(content, "\n")
+	content = strings.TrimSuffix(content, "\n")
+	r.out.WriteString("> " + strings.ReplaceAll(content, "\n", "\n> "))
+	if trailingBreak || (n.end < len(r.src) && r.src[n.end] != '\n') {
+		r.out.WriteString("\n")
+	}
+}
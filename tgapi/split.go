@@ -0,0 +1,136 @@
+package tgapi
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Places to split text at, from the most preferred: paragraphs, lines, sentences and words
+var splitSeparators = [][]string{
+	{"\n\n"},
+	{"\n"},
+	{". ", "! ", "? ", "… "},
+	{" "},
+}
+
+// MarkdownLength returns length of the text as Discord limits it. UTF-16 length is never less than number of characters.
+func MarkdownLength(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
+
+// markdownStyles returns every not space symbol of the Discord markdown text with formatting applied to it,
+// so texts can be compared by how they look
+func markdownStyles(text string) []string {
+	plain, entities := DiscordMarkdownToEntities(text)
+
+	var result []string
+	offset := 0
+	for _, r := range plain {
+		size := len(utf16.Encode([]rune{r}))
+		if !unicode.IsSpace(r) {
+			style := string(r)
+			for _, e := range entities {
+				if e.Offset <= offset && offset < e.Offset+e.Length {
+					style += "\x00" + e.Type + " " + e.URL + " " + e.Language
+				}
+			}
+			result = append(result, style)
+		}
+		offset += size
+	}
+
+	return result
+}
+
+// splitParts returns text before and after the position without whitespace between them
+func splitParts(text string, cut int) (string, string) {
+	return strings.TrimRightFunc(text[:cut], unicode.IsSpace), strings.TrimLeftFunc(text[cut:], unicode.IsSpace)
+}
+
+// splitPoint returns byte position to split the text at, so the first part fits the limit.
+// Position where both parts look the same as in the whole text is preferred, so markdown spans are not broken.
+func splitPoint(text string, limit int) int {
+	// The longest prefix fitting the limit, at least one symbol
+	window, length := 0, 0
+	for i, r := range text {
+		length += len(utf16.Encode([]rune{r}))
+		if length > limit && i > 0 {
+			break
+		}
+		window = i + len(string(r))
+	}
+
+	whole := markdownStyles(text)
+	isSafe := func(cut int) bool {
+		head, tail := splitParts(text, cut)
+		if head == "" {
+			return false
+		}
+		styles := append(markdownStyles(head), markdownStyles(tail)...)
+		if len(styles) != len(whole) {
+			return false
+		}
+		for i := range styles {
+			if styles[i] != whole[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Positions after every separator inside the window, the latest first
+	points := make([][]int, len(splitSeparators))
+	for i, separators := range splitSeparators {
+		for _, sep := range separators {
+			for from := 0; ; {
+				j := strings.Index(text[from:], sep)
+				if j < 0 || from+j+len(sep) > window {
+					break
+				}
+				from += j + len(sep)
+				points[i] = append(points[i], from)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(points[i])))
+	}
+
+	// Split near the limit is better than split at preferred separator far from it
+	for _, farther := range []bool{false, true} {
+		for _, cuts := range points {
+			for _, cut := range cuts {
+				if (cut < window/2) == farther && isSafe(cut) {
+					return cut
+				}
+			}
+		}
+	}
+
+	// Markdown is broken anyway, but words are kept when possible
+	result := window
+	if cuts := points[len(points)-1]; len(cuts) > 0 && strings.TrimSpace(text[:cuts[0]]) != "" {
+		result = cuts[0]
+	}
+
+	return result
+}
+
+// SplitMarkdown splits Discord markdown text into parts not longer than the limit without breaking markdown spans.
+// Paragraphs are split first, then lines, sentences and words, unless the split leaves the part less than half full.
+// Text is cut at the limit only if there is no such place.
+func SplitMarkdown(text string, limit int) []string {
+	var parts []string
+	for MarkdownLength(text) > limit {
+		var head string
+		head, text = splitParts(text, splitPoint(text, limit))
+		if head != "" {
+			parts = append(parts, head)
+		}
+	}
+	if text != "" || len(parts) == 0 {
+		parts = append(parts, text)
+	}
+
+	return parts
+}
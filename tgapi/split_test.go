@@ -0,0 +1,75 @@
+package tgapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitMarkdown(t *testing.T) {
+	cases := map[string]struct {
+		Text     string
+		Limit    int
+		Expected []string
+	}{
+		"short": {
+			Text:     "Lorem markdownum",
+			Limit:    20,
+			Expected: []string{"Lorem markdownum"},
+		},
+		"paragraphs": {
+			Text:     "Lorem markdownum.\n\nTemptabat ipsum dolor.",
+			Limit:    25,
+			Expected: []string{"Lorem markdownum.", "Temptabat ipsum dolor."},
+		},
+		"sentences": {
+			Text:     "Lorem markdownum. Temptabat ipsum dolor sit amet",
+			Limit:    30,
+			Expected: []string{"Lorem markdownum.", "Temptabat ipsum dolor sit amet"},
+		},
+		"words": {
+			Text:     "Lorem markdownum temptabat ipsum",
+			Limit:    20,
+			Expected: []string{"Lorem markdownum", "temptabat ipsum"},
+		},
+		"bold": {
+			Text:     "Lorem **markdownum temptabat** ipsum dolor",
+			Limit:    35,
+			Expected: []string{"Lorem **markdownum temptabat**", "ipsum dolor"},
+		},
+		"code block": {
+			Text:     "Lorem\n```\nmarkdownum\ntemptabat\n```\nipsum",
+			Limit:    30,
+			Expected: []string{"Lorem", "```\nmarkdownum\ntemptabat\n```", "ipsum"},
+		},
+		"quote": {
+			Text:     "> Lorem markdownum\n> temptabat ipsum",
+			Limit:    25,
+			Expected: []string{"> Lorem markdownum", "> temptabat ipsum"},
+		},
+		"long word": {
+			Text:     "Loremmarkdownum",
+			Limit:    10,
+			Expected: []string{"Loremmarkd", "ownum"},
+		},
+	}
+
+	for name, c := range cases {
+		parts := SplitMarkdown(c.Text, c.Limit)
+		if !reflect.DeepEqual(parts, c.Expected) {
+			t.Errorf("%s: got %q, expected %q", name, parts, c.Expected)
+		}
+	}
+}
+
+func TestSplitMarkdownLimit(t *testing.T) {
+	text := strings.Repeat("Lorem **markdownum** _temptabat_.\n", 300)
+	for _, part := range SplitMarkdown(text, 2000) {
+		if MarkdownLength(part) > 2000 {
+			t.Errorf("part is %d long", MarkdownLength(part))
+		}
+		if _, entities := DiscordMarkdownToEntities(part); len(entities) == 0 {
+			t.Errorf("markdown is lost in %q", part)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package tgapi
+
+import (
+	"encoding/json"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CustomEmojiSticker is a sticker of custom emoji, tgbotapi has no method to get them
+type CustomEmojiSticker struct {
+	FileID        string `json:"file_id"`
+	CustomEmojiID string `json:"custom_emoji_id"`
+	Emoji         string `json:"emoji"`
+	IsAnimated    bool   `json:"is_animated"`
+	IsVideo       bool   `json:"is_video"`
+	Thumbnail     *struct {
+		FileID string `json:"file_id"`
+	} `json:"thumbnail"`
+}
+
+// ImageFileID returns file of static image of the sticker: the sticker itself, or thumbnail of animated one.
+// Empty if there is no static image.
+func (s *CustomEmojiSticker) ImageFileID() string {
+	if !s.IsAnimated && !s.IsVideo {
+		return s.FileID
+	}
+	if s.Thumbnail != nil {
+		return s.Thumbnail.FileID
+	}
+
+	return ""
+}
+
+// GetCustomEmojiStickers returns stickers of custom emoji by their IDs
+func GetCustomEmojiStickers(bot *tgbotapi.BotAPI, ids []string) ([]CustomEmojiSticker, error) {
+	params := make(tgbotapi.Params)
+	if err := params.AddInterface("custom_emoji_ids", ids); err != nil {
+		return nil, err
+	}
+
+	resp, err := bot.MakeRequest("getCustomEmojiStickers", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var stickers []CustomEmojiSticker
+	err = json.Unmarshal(resp.Result, &stickers)
+
+	return stickers, err
+}
@@ -8,10 +8,10 @@ import (
 
 func NewBot(conf *config.Config, tr *http.Transport) (*tgbotapi.BotAPI, error) {
 	if conf.Proxy != nil {
-		return tgbotapi.NewBotAPIWithClient(conf.Telegram.Token, tgbotapi.APIEndpoint, &http.Client{
+		return tgbotapi.NewBotAPIWithClient(conf.Telegram.Token, conf.Telegram.GetAPIEndpoint(), &http.Client{
 			Transport: tr,
 		})
 	} else {
-		return tgbotapi.NewBotAPI(conf.Telegram.Token)
+		return tgbotapi.NewBotAPIWithAPIEndpoint(conf.Telegram.Token, conf.Telegram.GetAPIEndpoint())
 	}
 }
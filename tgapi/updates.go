@@ -0,0 +1,258 @@
+package tgapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// How long media spoiler flags, custom emoji and link preview options of received messages are remembered
+const messageInfoTTL = 24 * time.Hour
+
+type rawEntity struct {
+	Type          string `json:"type"`
+	Offset        int    `json:"offset"`
+	CustomEmojiID string `json:"custom_emoji_id"`
+}
+
+// rawMessage holds fields of Bot API message not supported by tgbotapi
+type rawMessage struct {
+	MessageID int `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	HasMediaSpoiler    bool                `json:"has_media_spoiler"`
+	Entities           []rawEntity         `json:"entities"`
+	CaptionEntities    []rawEntity         `json:"caption_entities"`
+	LinkPreviewOptions *LinkPreviewOptions `json:"link_preview_options"`
+}
+
+// LinkPreviewOptions tells how Telegram shows preview of the link in the message.
+// https://core.telegram.org/bots/api#linkpreviewoptions
+type LinkPreviewOptions struct {
+	IsDisabled bool `json:"is_disabled"`
+	// Link previewed, the first link of the text if empty
+	URL              string `json:"url"`
+	PreferSmallMedia bool   `json:"prefer_small_media"`
+	PreferLargeMedia bool   `json:"prefer_large_media"`
+	ShowAboveText    bool   `json:"show_above_text"`
+}
+
+type linkPreview struct {
+	Options *LinkPreviewOptions
+	Expires time.Time
+}
+
+// customEmojiIDs returns IDs of custom emoji of the message text or caption by entity offset
+func (m *rawMessage) customEmojiIDs() map[int]string {
+	result := make(map[int]string)
+	// Message has either text or caption
+	for _, e := range append(m.Entities, m.CaptionEntities...) {
+		if e.Type == "custom_emoji" && e.CustomEmojiID != "" {
+			result[e.Offset] = e.CustomEmojiID
+		}
+	}
+
+	return result
+}
+
+type rawUpdate struct {
+	Message           *rawMessage `json:"message"`
+	EditedMessage     *rawMessage `json:"edited_message"`
+	ChannelPost       *rawMessage `json:"channel_post"`
+	EditedChannelPost *rawMessage `json:"edited_channel_post"`
+}
+
+type customEmojiIDs struct {
+	IDs     map[int]string
+	Expires time.Time
+}
+
+var (
+	mediaSpoilers = make(map[string]time.Time)
+	customEmoji   = make(map[string]*customEmojiIDs)
+	linkPreviews  = make(map[string]*linkPreview)
+	messageInfoMu sync.Mutex
+)
+
+func messageKey(chatID int64, messageID int) string {
+	return fmt.Sprintf("%d,%d", chatID, messageID)
+}
+
+// recordMessages remembers messages of the raw updates which media is hidden under spoiler, their custom emoji
+// and link preview options
+func recordMessages(updates []rawUpdate) {
+	messageInfoMu.Lock()
+	defer messageInfoMu.Unlock()
+
+	now := time.Now()
+	for key, expires := range mediaSpoilers {
+		if now.After(expires) {
+			delete(mediaSpoilers, key)
+		}
+	}
+	for key, c := range customEmoji {
+		if now.After(c.Expires) {
+			delete(customEmoji, key)
+		}
+	}
+	for key, p := range linkPreviews {
+		if now.After(p.Expires) {
+			delete(linkPreviews, key)
+		}
+	}
+	for _, u := range updates {
+		for _, m := range []*rawMessage{u.Message, u.EditedMessage, u.ChannelPost, u.EditedChannelPost} {
+			if m == nil {
+				continue
+			}
+			key := messageKey(m.Chat.ID, m.MessageID)
+			if m.HasMediaSpoiler {
+				mediaSpoilers[key] = now.Add(messageInfoTTL)
+			}
+			if ids := m.customEmojiIDs(); len(ids) > 0 {
+				customEmoji[key] = &customEmojiIDs{IDs: ids, Expires: now.Add(messageInfoTTL)}
+			} else {
+				delete(customEmoji, key)
+			}
+			if m.LinkPreviewOptions != nil {
+				linkPreviews[key] = &linkPreview{Options: m.LinkPreviewOptions, Expires: now.Add(messageInfoTTL)}
+			} else {
+				delete(linkPreviews, key)
+			}
+		}
+	}
+}
+
+// HasMediaSpoiler reports that media of the message is covered with spoiler animation
+func HasMediaSpoiler(msg *tgbotapi.Message) bool {
+	messageInfoMu.Lock()
+	defer messageInfoMu.Unlock()
+
+	_, ok := mediaSpoilers[messageKey(msg.Chat.ID, msg.MessageID)]
+	return ok
+}
+
+// CustomEmojiIDs returns IDs of custom emoji in text or caption of the message by offset of their entities
+func CustomEmojiIDs(msg *tgbotapi.Message) map[int]string {
+	messageInfoMu.Lock()
+	defer messageInfoMu.Unlock()
+
+	if c, ok := customEmoji[messageKey(msg.Chat.ID, msg.MessageID)]; ok {
+		return c.IDs
+	}
+
+	return nil
+}
+
+// GetLinkPreviewOptions returns link preview options of the message, nil if Telegram sent none
+func GetLinkPreviewOptions(msg *tgbotapi.Message) *LinkPreviewOptions {
+	messageInfoMu.Lock()
+	defer messageInfoMu.Unlock()
+
+	if p, ok := linkPreviews[messageKey(msg.Chat.ID, msg.MessageID)]; ok {
+		return p.Options
+	}
+
+	return nil
+}
+
+// MessageInfo holds fields of the message tgbotapi does not know about, so they can be stored with the message
+type MessageInfo struct {
+	HasMediaSpoiler    bool                `json:"has_media_spoiler,omitempty"`
+	CustomEmojiIDs     map[int]string      `json:"custom_emoji_ids,omitempty"`
+	LinkPreviewOptions *LinkPreviewOptions `json:"link_preview_options,omitempty"`
+}
+
+// GetMessageInfo returns remembered fields of the message tgbotapi does not know about
+func GetMessageInfo(msg *tgbotapi.Message) *MessageInfo {
+	return &MessageInfo{
+		HasMediaSpoiler:    HasMediaSpoiler(msg),
+		CustomEmojiIDs:     CustomEmojiIDs(msg),
+		LinkPreviewOptions: GetLinkPreviewOptions(msg),
+	}
+}
+
+// RecordMessageInfo remembers fields of the message stored before, as if the message was received again
+func RecordMessageInfo(msg *tgbotapi.Message, info *MessageInfo) {
+	messageInfoMu.Lock()
+	defer messageInfoMu.Unlock()
+
+	key := messageKey(msg.Chat.ID, msg.MessageID)
+	expires := time.Now().Add(messageInfoTTL)
+	if info.HasMediaSpoiler {
+		mediaSpoilers[key] = expires
+	}
+	if len(info.CustomEmojiIDs) > 0 {
+		customEmoji[key] = &customEmojiIDs{IDs: info.CustomEmojiIDs, Expires: expires}
+	}
+	if info.LinkPreviewOptions != nil {
+		linkPreviews[key] = &linkPreview{Options: info.LinkPreviewOptions, Expires: expires}
+	}
+}
+
+// parseUpdates decodes updates and remembers fields tgbotapi does not know about
+func parseUpdates(data []byte) ([]tgbotapi.Update, error) {
+	var raw []rawUpdate
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	recordMessages(raw)
+
+	var updates []tgbotapi.Update
+	err := json.Unmarshal(data, &updates)
+
+	return updates, err
+}
+
+// parseUpdate decodes single update, the same way as parseUpdates
+func parseUpdate(data []byte) (*tgbotapi.Update, error) {
+	var raw rawUpdate
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	recordMessages([]rawUpdate{raw})
+
+	var update tgbotapi.Update
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, err
+	}
+
+	return &update, nil
+}
+
+// GetUpdatesChan receives updates with long polling, same as tgbotapi.BotAPI.GetUpdatesChan
+// but keeps the fields tgbotapi does not know about.
+func GetUpdatesChan(bot *tgbotapi.BotAPI, config tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel {
+	ch := make(chan tgbotapi.Update, bot.Buffer)
+
+	go func() {
+		for {
+			resp, err := bot.Request(config)
+			var updates []tgbotapi.Update
+			if err == nil {
+				updates, err = parseUpdates(resp.Result)
+			}
+			if err != nil {
+				log.Println(err)
+				log.Println("Failed to get updates, retrying in 3 seconds...")
+				time.Sleep(time.Second * 3)
+
+				continue
+			}
+
+			for _, update := range updates {
+				if update.UpdateID >= config.Offset {
+					config.Offset = update.UpdateID + 1
+					ch <- update
+				}
+			}
+		}
+	}()
+
+	return ch
+}
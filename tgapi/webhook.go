@@ -0,0 +1,154 @@
+package tgapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reposter/config"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// Webhook receives updates from Telegram with embedded HTTP(S) server.
+type Webhook struct {
+	Updates tgbotapi.UpdatesChannel
+
+	bot    *tgbotapi.BotAPI
+	server *http.Server
+}
+
+// randomSecretToken returns secret token for the webhook which is not set in config
+func randomSecretToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// NewWebhook starts HTTP(S) server and registers it with setWebhook.
+// Requests without secret token are rejected, random one is used if it is not set in config.
+func NewWebhook(conf *config.Config, bot *tgbotapi.BotAPI) (*Webhook, error) {
+	whConf := *conf.Telegram.Webhook
+	if whConf.SecretToken == "" {
+		log.Printf("Webhook secret token is not set, random one is used")
+		token, err := randomSecretToken()
+		if err != nil {
+			return nil, err
+		}
+		whConf.SecretToken = token
+	}
+
+	path := whConf.Path
+	if path == "" {
+		u, err := url.Parse(whConf.URL)
+		if err != nil {
+			return nil, err
+		}
+		path = u.Path
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	ch := make(chan tgbotapi.Update, bot.Buffer)
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(secretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(whConf.SecretToken)) != 1 {
+			log.Printf("Webhook request from %s with wrong secret token rejected", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		var u *tgbotapi.Update
+		if err == nil {
+			u, err = parseUpdate(body)
+		}
+		if err != nil {
+			log.Printf("Cannot parse webhook update! See error: %s", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ch <- *u
+	})
+
+	wh := &Webhook{
+		Updates: ch,
+		bot:     bot,
+		server: &http.Server{
+			Addr:    whConf.Listen,
+			Handler: mux,
+		},
+	}
+
+	go func() {
+		var err error
+		if whConf.Cert != "" && whConf.Key != "" {
+			err = wh.server.ListenAndServeTLS(whConf.Cert, whConf.Key)
+		} else {
+			err = wh.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Webhook server stopped! See error: %s", err.Error())
+		}
+	}()
+
+	if err := setWebhook(bot, &whConf); err != nil {
+		wh.server.Close()
+		return nil, err
+	}
+
+	return wh, nil
+}
+
+func setWebhook(bot *tgbotapi.BotAPI, whConf *config.TelegramWebhook) error {
+	params := make(tgbotapi.Params)
+	params["url"] = whConf.URL
+	params["secret_token"] = whConf.SecretToken
+
+	if whConf.SelfSigned && whConf.Cert != "" {
+		_, err := bot.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{
+			{
+				Name: "certificate",
+				Data: tgbotapi.FilePath(whConf.Cert),
+			},
+		})
+		return err
+	}
+
+	_, err := bot.MakeRequest("setWebhook", params)
+
+	return err
+}
+
+// DeleteWebhook removes webhook, so updates can be received with long polling.
+func DeleteWebhook(bot *tgbotapi.BotAPI) error {
+	_, err := bot.Request(tgbotapi.DeleteWebhookConfig{})
+
+	return err
+}
+
+// Close deletes webhook and stops the server.
+func (wh *Webhook) Close() {
+	if err := DeleteWebhook(wh.bot); err != nil {
+		log.Printf("Cannot delete webhook! See error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wh.server.Shutdown(ctx); err != nil {
+		log.Printf("Cannot stop webhook server! See error: %s", err.Error())
+	}
+}